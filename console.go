@@ -1,9 +1,6 @@
 package main
 
-import (
-	"fmt"
-	"os"
-)
+import "os"
 
 type KL11 struct {
 	rcsr, rbuf, xcsr uint16
@@ -22,29 +19,31 @@ func (kl *KL11) reset() {
 
 func (kl *KL11) xmitready() bool { return kl.xcsr&0x80 > 0 }
 
-func (kl *KL11) read16(a addr18) uint16 {
+// busy reports whether a character is being transmitted.
+func (kl *KL11) busy() bool { return kl.xbuf > 0 || kl.count > 0 }
+
+func (kl *KL11) read16(a addr18) (uint16, bool) {
 	// fmt.Printf("kl11:read16: %06o\n", a)
 	switch a {
 	case 0777560:
 		// 777560 Receive Control and Status register
-		return kl.rcsr
+		return kl.rcsr, true
 	case 0777562:
 		// 777562 Receive Buffer
 		kl.rcsr &^= 0x80
-		return kl.rbuf
+		return kl.rbuf, true
 	case 0777564:
 		// 777564 Transmit Control and Status register
-		return kl.xcsr
+		return kl.xcsr, true
 	case 0777566:
 		// 777566 Transmit Buffer
-		return 0 // write only
+		return 0, true // write only
 	default:
-		fmt.Printf("KL11: read from invalid address %06o\n", a)
-		panic(trap{INTBUS})
+		return 0, false
 	}
 }
 
-func (kl *KL11) write16(a addr18, v uint16) {
+func (kl *KL11) write16(a addr18, v uint16) bool {
 	//fmt.Printf("kl11:write16: %06o %06o\n", a, v)
 	switch a {
 	case 0777560:
@@ -63,12 +62,14 @@ func (kl *KL11) write16(a addr18, v uint16) {
 		kl.xbuf = byte(v & 0x7f)
 		kl.xcsr &^= 0x80
 	default:
-		fmt.Printf("KL11: write to invalid address %06o\n", a)
-		panic(trap{INTBUS})
+		return false
 	}
+	return true
 }
 
-func (kl *KL11) step() {
+// poll polls the console for input and returns the interrupt it raises,
+// if any.
+func (kl *KL11) poll() interrupt {
 	if kl.rcsr&0x80 == 0 {
 		// receiver not busy, poll for character
 		select {
@@ -78,12 +79,18 @@ func (kl *KL11) step() {
 			kl.rbuf = uint16(c & 0x7f)
 			kl.rcsr |= 0x80
 			if kl.rcsr&0x40 > 0 {
-				panic(interrupt{INTTTYIN, 4})
+				return interrupt{INTTTYIN, 4}
 			}
 
 		default:
 		}
 	}
+	return interrupt{}
+}
+
+// step transmits the character in the transmit buffer and returns the
+// interrupt it raises, if any.
+func (kl *KL11) step() interrupt {
 	if kl.xbuf > 0 {
 		os.Stderr.Write([]byte{byte(kl.xbuf)})
 		kl.xbuf = 0
@@ -94,8 +101,9 @@ func (kl *KL11) step() {
 		if kl.count == 0 {
 			kl.xcsr |= 0x80
 			if kl.xcsr&0x40 > 0 {
-				panic(interrupt{INTTTYOUT, 4})
+				return interrupt{INTTTYOUT, 4}
 			}
 		}
 	}
+	return interrupt{}
 }
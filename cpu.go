@@ -2,434 +2,308 @@ package main
 
 import (
 	"fmt"
+	"math/bits"
 	"os"
-	"runtime"
+	"strings"
+	"time"
 )
 
 type KB11 struct {
+	model  *model
 	unibus UNIBUS
 	mmu    KT11
+	fp     FP11
 
 	pc uint16    // holds R[7] during instruction execution
 	R  [8]uint16 // R0-R7
 
-	psw                                         uint16    // processor status word
-	stackpointer                                [4]uint16 // Alternate R6 (kernel, super, illegal, user)
+	psw                                         uint16       // processor status word
+	stackpointer                                [4]uint16    // Alternate R6 (kernel, super, illegal, user)
+	registerset                                 [2][6]uint16 // R0-R5 of the register set not in use
 	stacklimit, switchregister, displayregister uint16
+	pirq                                        uint16 // program interrupt requests, bits 15-9
 
-	interrupts [8]struct{ vec, pri uint16 }
+	yellow  bool // a yellow zone stack violation traps after this instruction
+	trace   bool // the T bit was set when this instruction started
+	waiting bool // WAIT, no instructions run until an interrupt
+	halted  bool // HALT, the cpu stops and Run returns to the monitor
+
+	monitor *monitor // the console monitor, if any
+
+	abort bool // the current instruction has been aborted by a trap
+	saved struct {
+		vec          uint16 // the vector of the pending trap
+		R            [8]uint16
+		psw          uint16
+		stackpointer [4]uint16
+		registerset  [2][6]uint16
+		fp           FP11
+	}
+
+	interrupts [8]interrupt
 
 	print bool
 }
 
+// Reset asserts INIT, as RESET does. The devices are reset, memory
+// management is turned off and the program interrupt requests, the stack
+// limit and any pending interrupts are cleared.
 func (kb *KB11) Reset() {
 	kb.unibus.reset()
+	kb.mmu.SR0 = 0
+	kb.mmu.SR3 = 0
+	kb.mmu.flush()
+	kb.pirq = 0
+	kb.stacklimit = 0
+	kb.interrupts = [8]interrupt{}
 }
 
+// start resets the cpu as the console START switch does. It asserts INIT,
+// like RESET, and also clears the PSW, the FP11 and any pending trap or
+// WAIT.
+func (kb *KB11) start() {
+	kb.Reset()
+	kb.writePSW(0)
+	kb.fp = FP11{}
+	kb.waiting, kb.abort = false, false
+	kb.mmu.trap, kb.yellow, kb.trace = false, false, false
+}
+
+// Run runs the cpu. When it halts Run syncs the disk images and drops into
+// the console monitor, if there is one, otherwise it returns a *HaltError.
 func (kb *KB11) Run() error {
 	for {
 		kb.run()
+		fmt.Printf("HALT\n")
+		kb.printstate()
+		if err := kb.unibus.rk11.Sync(); err != nil {
+			fmt.Fprintf(os.Stderr, "rk11: %v\r\n", err)
+		}
+		if kb.monitor == nil {
+			return &HaltError{PC: kb.R[7]}
+		}
+		if !kb.monitor.run(kb) {
+			return nil
+		}
+		kb.halted = false
 	}
-	return nil
 }
 
+// run runs the cpu until it halts.
 func (kb *KB11) run() {
-	defer func() {
-		t := recover()
-		switch t := t.(type) {
-		case trap:
-			kb.trapat(t.vec)
-		case interrupt:
-			defer fmt.Printf("interrupt queued: vec: %03o pri: %03o\n", t.vec, t.pri)
-			if t.vec&1 == 1 {
-				panic("Thou darst calling interrupt() with an odd vector number?")
-			}
-			// fast path
-			if kb.interrupts[0].vec == 0 {
-				kb.interrupts[0].vec = t.vec
-				kb.interrupts[0].pri = t.pri
-				return
-			}
-			var i int
-			for ; i < len(kb.interrupts); i++ {
-				if kb.interrupts[i].vec == 0 || kb.interrupts[i].pri < t.pri {
-					break
-				}
-			}
-			for ; i < len(kb.interrupts); i++ {
-				if kb.interrupts[i].vec == 0 || kb.interrupts[i].vec >= t.vec {
-					break
-				}
-			}
-			if i == len(kb.interrupts) {
-				panic("interrupt table full")
+	for n := 0; !kb.halted; n++ {
+		if kb.pirq != 0 || kb.interrupts[0].vec != 0 {
+			kb.takeinterrupt()
+		}
+		if kb.abort {
+			kb.aborttrap()
+		}
+
+		if kb.waiting {
+			if !kb.unibus.busy() {
+				// idle until a device interrupts
+				time.Sleep(waitpoll)
 			}
-			for j := i + 1; j < len(kb.interrupts); j++ {
-				kb.interrupts[j] = kb.interrupts[j-1]
+		} else {
+			kb.step()
+			if kb.abort || kb.mmu.trap || kb.yellow || kb.trace {
+				kb.traps()
 			}
-			kb.interrupts[i].vec = t.vec
-			kb.interrupts[i].pri = t.pri
-		default:
-			panic(t)
 		}
-	}()
-
-	for {
-		if kb.interrupts[0].vec > 0 && kb.interrupts[0].pri >= kb.priority() {
-			fmt.Printf("interrupt: vec: %03o pri: %03o\n", kb.interrupts[0].vec, kb.interrupts[0].pri)
-			kb.trapat(kb.interrupts[0].vec)
-			copy(kb.interrupts[:8], kb.interrupts[1:])
-			kb.interrupts[7].vec = 0
-			kb.interrupts[7].pri = 0
+		kb.queueinterrupt(kb.unibus.rk11.step())
+		kb.queueinterrupt(kb.unibus.cons.step())
+		if kb.waiting || n%pollinterval == 0 {
+			kb.queueinterrupt(kb.unibus.cons.poll())
+			kb.queueinterrupt(kb.unibus.lineclock.tick())
 		}
+	}
+}
+
+// traps takes the traps left pending by the last instruction in hardware
+// priority order, an abort by a bus error or the MMU, a memory management
+// trap, a yellow zone stack violation and then the trace trap. If taking a
+// trap aborts, the trace trap is not taken.
+func (kb *KB11) traps() {
+	if kb.abort {
+		// an aborted instruction did not complete
+		kb.mmu.trap = false
+		kb.trace = false
+		kb.aborttrap()
+	}
+	if kb.mmu.trap {
+		kb.mmu.trap = false
+		kb.trapat(INTFAULT)
+	}
+	if kb.yellow && !kb.abort {
+		kb.trapat(INTBUS)
+		// pushing the yellow zone trap does not trap again
+		kb.yellow = false
+	}
+	if kb.trace && !kb.abort {
+		kb.trapat(INTDEBUG)
+	}
+	kb.trace = false
+}
 
-		kb.step()
-		kb.unibus.rk11.step()
-		kb.unibus.cons.step()
-		kb.unibus.lineclock.tick()
+// trap aborts the current instruction, which traps to vec once it returns.
+// The registers are saved as they were when the trap happened, the rest of
+// the instruction's memory references are ignored and its changes to the
+// registers are undone. Only the first trap of an instruction counts.
+func (kb *KB11) trap(vec uint16) {
+	if kb.abort {
+		return
 	}
+	kb.abort = true
+	kb.saved.vec = vec
+	kb.saved.R = kb.R
+	kb.saved.psw = kb.psw
+	kb.saved.stackpointer = kb.stackpointer
+	kb.saved.registerset = kb.registerset
+	kb.saved.fp = kb.fp
 }
 
-// Load loads words into memory starting at offset bypassing the mmu.
-func (kb *KB11) Load(offset addr18, words ...uint16) {
-	for i, w := range words {
-		kb.unibus.write16(offset+addr18(i*2), w)
+// aborttrap restores the registers saved when the current instruction was
+// aborted and takes the pending trap.
+func (kb *KB11) aborttrap() {
+	kb.abort = false
+	kb.R = kb.saved.R
+	kb.psw = kb.saved.psw
+	kb.stackpointer = kb.saved.stackpointer
+	kb.registerset = kb.saved.registerset
+	kb.fp = kb.saved.fp
+	R, psw, stackpointer := kb.R, kb.psw, kb.stackpointer
+	vec := kb.saved.vec
+	kb.trapat(vec)
+	if kb.abort {
+		// the trap itself failed, try again from the same state using
+		// the emergency stack
+		if kb.print {
+			fmt.Printf("trap: vec: %03o failed, using the emergency stack\n", vec)
+		}
+		kb.abort = false
+		kb.R, kb.psw, kb.stackpointer = R, psw, stackpointer
+		kb.unibus.cpuerr |= CPUERRRED // a fatal stack error
+		if kb.currentmode() == 0 {
+			kb.R[6] = 4
+		} else {
+			kb.stackpointer[0] = 4
+		}
+		kb.trapat(INTBUS)
+		if kb.abort {
+			// a double bus error halts the cpu
+			kb.abort = false
+			kb.halted = true
+		}
 	}
 }
 
-func (kb *KB11) step() {
-	kb.pc = kb.R[7]
-	instr := kb.fetch16()
+// queueinterrupt adds the device interrupt i, if any, to the queue of
+// pending interrupts, in priority and then vector order.
+func (kb *KB11) queueinterrupt(i interrupt) {
+	if i.vec != 0 {
+		kb.enqueue(i)
+	}
+}
 
+// enqueue adds the device interrupt i to the queue of pending interrupts.
+// Like a bus request line, a vector is either pending or not, so it is
+// queued only once however many times its device asks to interrupt.
+func (kb *KB11) enqueue(i interrupt) {
 	if kb.print {
-		kb.printstate()
+		fmt.Printf("interrupt queued: vec: %03o pri: %03o\n", i.vec, i.pri)
 	}
-
-	switch instr >> 12 { // xxSSDD Mostly double operand instructions
-	case 0: // 00xxxx mixed group
-		switch instr >> 8 { // 00xxxx 8 bit instructions first (branch & JSR)
-		case 0: // 000xXX Misc zero group
-			switch instr >> 6 { // 000xDD group (4 case full decode)
-			case 0: // 0000xx group
-				switch instr {
-				case 0: // HALT 000000
-					println("HALT")
-					kb.printstate()
-					os.Exit(1)
-				case 1: // WAIT 000001
-					kb.WAIT()
-					return
-				case 3: // BPT  000003
-					kb.trapat(014) // Trap 14 - BPT
-					return
-				case 4: // IOT  000004
-					kb.trapat(020)
-					return
-				case 5: // RESET 000005
-					kb.RESET()
-					return
-				case 2, 6: // RTI 000002, RTT 000006
-					kb.RTT()
-					return
-				case 7: // MFPT
-					kb.MFPT()
-					return
-				default: // We don't know this 0000xx instruction
-					fmt.Printf("unknown 0000xx instruction\n")
-					kb.printstate()
-					kb.trapat(INTINVAL)
-					return
-				}
-			case 1: // JMP 0001DD
-				kb.JMP(instr)
-				return
-			case 2: // 00002xR single register group
-				switch (instr >> 3) & 7 { // 00002xR register or CC
-				case 0: // RTS 00020R
-					kb.RTS(instr)
-					return
-				case 3: // SPL 00023N
-					kb.writePSW((kb.psw & 0xf81f) | ((instr & 7) << 5))
-					return
-				case 4, 5: // CLR CC 00024C Part 1 without N, CLR CC 00025C Part 2 with N
-					kb.writePSW(kb.psw & (^instr & 017))
-					return
-				case 6, 7: // SET CC 00026C Part 1 without N, SET CC 00027C Part 2 with N
-					kb.writePSW(kb.psw | (instr & 017))
-					return
-				default: // We don't know this 00002xR instruction
-					fmt.Printf("unknown 0002xR instruction\n")
-					kb.printstate()
-					panic(trap{INTINVAL})
-
-				}
-			case 3: // SWAB 0003DD
-				kb.SWAB(instr)
-				return
-			default:
-				fmt.Printf("unknown 000xDD instruction\n")
-				kb.printstate()
-				panic(trap{INTINVAL})
-			}
-		case 1: // BR 0004 offset
-			kb.branch(instr)
-			return
-		case 2: // BNE 0010 offset
-			if !kb.z() {
-				kb.branch(instr)
-			}
-			return
-		case 3: // BEQ 0014 offset
-			if kb.z() {
-				kb.branch(instr)
-			}
-			return
-		case 4: // BGE 0020 offset
-			if !(kb.n() != kb.v()) {
-				kb.branch(instr)
-			}
-			return
-		case 5: // BLT 0024 offset
-			if kb.n() != kb.v() {
-				kb.branch(instr)
-			}
-			return
-		case 6: // BGT 0030 offset
-			if (!(kb.n() != kb.v())) && (!kb.z()) {
-				kb.branch(instr)
-			}
-			return
-		case 7: // BLE 0034 offset
-			if (kb.n() != kb.v()) || kb.z() {
-				kb.branch(instr)
-			}
-			return
-		case 8, 9: // JSR 004RDD In two parts, JSR 004RDD continued (9 bit instruction so use 2 x 8 bit
-			kb.JSR(instr)
-			return
-		default: // Remaining 0o00xxxx instructions where xxxx >= 05000
-			switch instr >> 6 { // 00xxDD
-			case 050: // CLR 0050DD
-				kb.CLR(2, instr)
-				return
-			case 051: // COM 0051DD
-				kb.COM(2, instr)
-				return
-			case 052: // INC 0052DD
-				kb.INC(2, instr)
-				return
-			case 053: // DEC 0053DD
-				kb.DEC(2, instr)
-				return
-			case 054: // NEG 0054DD
-				kb.NEG(2, instr)
-				return
-			case 055: // ADC 0055DD
-				kb.ADC(2, instr)
-				return
-			case 056: // SBC 0056DD
-				kb.SBC(2, instr)
-				return
-			case 057: // TST 0057DD
-				kb.TST(2, instr)
-				return
-			case 060: // ROR 0060DD
-				kb.ROR(2, instr)
-				return
-			case 061: // ROL 0061DD
-				kb.ROL(2, instr)
-				return
-			case 062: // ASR 0062DD
-				kb.ASR(2, instr)
-				return
-			case 063: // ASL 0063DD
-				kb.ASL(2, instr)
-				return
-			case 064: // MARK 0064nn
-				kb.MARK(instr)
-				return
-			case 065: // MFPI 0065SS
-				kb.MFPI(instr)
-				return
-			case 066: // MTPI 0066DD
-				kb.MTPI(instr)
-				return
-			case 067: // SXT 0067DD
-				kb.SXT(instr)
-				return
-			default: // We don't know this 0o00xxDD instruction
-				fmt.Printf("unknown 00xxDD instruction\n")
-				kb.printstate()
-				panic(trap{INTINVAL})
-			}
-		}
-	case 1: // MOV  01SSDD
-		kb.MOV(2, instr)
-		return
-	case 2: // CMP 02SSDD
-		kb.CMP(2, instr)
-		return
-	case 3: // BIT 03SSDD
-		kb.BIT(2, instr)
-		return
-	case 4: // BIC 04SSDD
-		kb.BIC(2, instr)
-		return
-	case 5: // BIS 05SSDD
-		kb.BIS(2, instr)
-		return
-	case 6: // ADD 06SSDD
-		kb.ADD(instr)
+	if i.vec&1 == 1 {
+		panic("Thou darst calling interrupt() with an odd vector number?")
+	}
+	// fast path
+	if kb.interrupts[0].vec == 0 {
+		kb.interrupts[0] = i
 		return
-	case 7: // 07xRSS instructions
-		switch (instr >> 9) & 7 { // 07xRSS
-		case 0: // MUL 070RSS
-			kb.MUL(instr)
-			return
-		case 1: // DIV 071RSS
-			kb.DIV(instr)
-			return
-		case 2: // ASH 072RSS
-			kb.ASH(instr)
-			return
-		case 3: // ASHC 073RSS
-			kb.ASHC(instr)
-			return
-		case 4: // XOR 074RSS
-			kb.XOR(instr)
-			return
-		case 7: // SOB 077Rnn
-			kb.SOB(instr)
+	}
+	n := -1
+	for j, e := range kb.interrupts {
+		if e.vec == i.vec {
 			return
-		default: // We don't know this 07xRSS instruction
-			fmt.Printf("unknown 07xRSS instruction\n")
-			kb.printstate()
-			panic(trap{INTINVAL})
 		}
-	case 8: // 10xxxx instructions
-		switch (instr >> 8) & 0xf { // 10xxxx 8 bit instructions first
-		case 0: // BPL 1000 offset
-			if !kb.n() {
-				kb.branch(instr)
-			}
-			return
-		case 1: // BMI 1004 offset
-			if kb.n() {
-				kb.branch(instr)
-			}
-			return
-		case 2: // BHI 1010 offset
-			if (!kb.c()) && (!kb.z()) {
-				kb.branch(instr)
-			}
-			return
-		case 3: // BLOS 1014 offset
-			if kb.c() || kb.z() {
-				kb.branch(instr)
-			}
-			return
-		case 4: // BVC 1020 offset
-			if !kb.v() {
-				kb.branch(instr)
-			}
-			return
-		case 5: // BVS 1024 offset
-			if kb.v() {
-				kb.branch(instr)
-			}
-			return
-		case 6: // BCC 1030 offset
-			if !kb.c() {
-				kb.branch(instr)
-			}
-			return
-		case 7: // BCS 1034 offset
-			if kb.c() {
-				kb.branch(instr)
-			}
-			return
-		case 8: // EMT 1040 operand
-			kb.trapat(030) // Trap 30 - EMT instruction
-			return
-		case 9: // TRAP 1044 operand
-			kb.trapat(034) // Trap 34 - TRAP instruction
-			return
-		default: // Remaining 10xxxx instructions where xxxx >= 05000
-			switch (instr >> 6) & 077 { // 10xxDD group
-			case 050: // CLRB 1050DD
-				kb.CLR(1, instr)
-				return
-			case 051: // COMB 1051DD
-				kb.COM(1, instr)
-				return
-			case 052: // INCB 1052DD
-				kb.INC(1, instr)
-				return
-			case 053: // DECB 1053DD
-				kb.DEC(1, instr)
-				return
-			case 054: // NEGB 1054DD
-				kb.NEG(1, instr)
-				return
-			case 055: // ADCB 01055DD
-				kb.ADC(1, instr)
-				return
-			case 056: // SBCB 01056DD
-				kb.SBC(1, instr)
-				return
-			case 057: // TSTB 1057DD
-				kb.TST(1, instr)
-				return
-			case 060: // RORB 1060DD
-				kb.ROR(1, instr)
-				return
-			case 061: // ROLB 1061DD
-				kb.ROL(1, instr)
-				return
-			case 062: // ASRB 1062DD
-				kb.ASR(1, instr)
-				return
-			case 063: // ASLB 1063DD
-				kb.ASL(1, instr)
-				return
-			// case 0o64: // MTPS 1064SS
-			// case 0o65: // MFPD 1065DD
-			// case 0o66: // MTPD 1066DD
-			// case 0o67: // MTFS 1064SS
-			default: // We don't know this 0o10xxDD instruction
-				fmt.Printf("unknown 0o10xxDD instruction\n")
-				kb.printstate()
-				panic(trap{INTINVAL})
-			}
+		if n < 0 && (e.vec == 0 || e.pri < i.pri || e.pri == i.pri && e.vec > i.vec) {
+			n = j
 		}
-	case 9: // MOVB 11SSDD
-		kb.MOV(1, instr)
-		return
-	case 10: // CMPB 12SSDD
-		kb.CMP(1, instr)
-		return
-	case 11: // BITB 13SSDD
-		kb.BIT(1, instr)
-		return
-	case 12: // BICB 14SSDD
-		kb.BIC(1, instr)
-		return
-	case 13: // BISB 15SSDD
-		kb.BIS(1, instr)
-		return
-	case 14: // SUB 16SSDD
-		kb.SUB(instr)
+	}
+	if n < 0 || kb.interrupts[len(kb.interrupts)-1].vec != 0 {
+		// each device has its own vector, so there is room for all of
+		// them
+		panic("interrupt table full")
+	}
+	copy(kb.interrupts[n+1:], kb.interrupts[n:])
+	kb.interrupts[n] = i
+}
+
+// takeinterrupt takes the highest priority pending interrupt, if any, which is
+// either a queued device interrupt or a program interrupt request. Taking an
+// interrupt ends a WAIT. A device interrupt stays queued if the trap to it
+// fails, so it is taken once the abort has been dealt with.
+func (kb *KB11) takeinterrupt() {
+	if pri := kb.pirqlevel(); pri > kb.priority() && (kb.interrupts[0].vec == 0 || pri >= kb.interrupts[0].pri) {
+		if kb.print {
+			fmt.Printf("interrupt: vec: %03o pri: %03o\n", INTPIRQ, pri)
+		}
+		kb.waiting = false
+		kb.trapat(INTPIRQ)
 		return
-	case 15:
-		if instr == 0170011 {
-			// SETD ; not needed by UNIX, but used; therefore ignored
+	}
+	if kb.interrupts[0].vec > 0 && kb.interrupts[0].pri > kb.priority() {
+		kb.waiting = false
+		if kb.print {
+			fmt.Printf("interrupt: vec: %03o pri: %03o\n", kb.interrupts[0].vec, kb.interrupts[0].pri)
+		}
+		R, psw, stackpointer := kb.R, kb.psw, kb.stackpointer
+		kb.trapat(kb.interrupts[0].vec)
+		if kb.abort {
+			// the abort traps from the interrupted state
+			kb.saved.R, kb.saved.psw, kb.saved.stackpointer = R, psw, stackpointer
 			return
 		}
-	default: // 15  17xxxx FPP instructions
-		fmt.Printf("invalid 17xxxx FPP instruction\n")
+		copy(kb.interrupts[:], kb.interrupts[1:])
+		kb.interrupts[len(kb.interrupts)-1] = interrupt{}
+	}
+}
+
+// pirqlevel returns the highest pending program interrupt request level,
+// or zero if there are none.
+func (kb *KB11) pirqlevel() uint16 { return uint16(bits.Len16(kb.pirq >> 9)) }
+
+// readpirq returns the PIRQ register, the request bits with the highest
+// pending level encoded in both the PIA fields, bits 7-5 and 3-1.
+func (kb *KB11) readpirq() uint16 {
+	pri := kb.pirqlevel()
+	return kb.pirq | pri<<5 | pri<<1
+}
+
+// Load loads words into memory starting at offset bypassing the mmu.
+func (kb *KB11) Load(offset addr22, words ...uint16) {
+	for i, w := range words {
+		kb.unibus.write16(offset+addr22(i*2), w)
+	}
+}
+
+func (kb *KB11) step() {
+	kb.pc = kb.R[7]
+	kb.trace = kb.psw&PSWT == PSWT
+	if !kb.mmu.frozen() {
+		// SR1 and SR2 describe the current instruction
+		kb.mmu.SR1 = 0
+		kb.mmu.SR2 = kb.pc
+	}
+	instr := kb.fetch16()
+	if kb.abort {
+		return
+	}
+
+	if kb.print {
 		kb.printstate()
-		panic(trap{INTINVAL})
 	}
+
+	optable[instr](kb, instr)
 }
 
 func (kb *KB11) RESET() {
@@ -437,41 +311,58 @@ func (kb *KB11) RESET() {
 		// RESET is ignored outside of kernel mode
 		return
 	}
-	kb.unibus.reset()
+	kb.Reset()
 }
 
+// waitpoll is how often a waiting cpu checks for device interrupts when no
+// device is busy.
+const waitpoll = time.Millisecond
+
+// pollinterval is how many instructions the cpu executes between polls of
+// the console input and the line clock. Receiving from a channel costs more
+// than most instructions.
+const pollinterval = 64
+
+// WAIT 000001
 func (kb *KB11) WAIT() {
-	fmt.Printf("WAIT\n")
-	kb.printstate()
-	runtime.Breakpoint()
+	if kb.currentmode() > 0 {
+		// WAIT is a no-op outside of kernel mode
+		return
+	}
+	kb.waiting = true
 }
 
 // RTI 000004, RTT 000006
 func (kb *KB11) RTT() {
-	kb.R[7] = kb.pop()
+	pc := kb.pop()
 	psw := kb.pop()
+	kb.R[7] = pc
 	psw &= 0xf8ff
 	if kb.currentmode() > 0 { // user / super restrictions
 		// keep SPL and allow lower only for modes and register set
-		psw = (psw & 0xf81f) | (psw & 0xf8e0)
+		psw = (psw & 0xf81f) | (kb.psw & 0xf8e0)
 	}
 	kb.writePSW(psw)
 }
 
 // MFPT 000007
 func (kb *KB11) MFPT() {
-	kb.trapat(010) // not a PDP11/44
+	if kb.model == nil || kb.model.mfpt == 0 {
+		kb.trap(INTINVAL) // not a PDP11/44
+		return
+	}
+	kb.R[0] = kb.model.mfpt
 }
 
 // JMP 0001DD
 func (kb *KB11) JMP(instr uint16) {
 	if ((instr >> 3) & 7) == 0 {
-		// Registers don't have a virtual address so trap!
-		fmt.Printf("JMP called on register\n")
-		kb.printstate()
-		os.Exit(1)
+		// Registers don't have a virtual address so trap! The CPU
+		// error register has no bit for an illegal instruction.
+		kb.trap(INTBUS)
+		return
 	}
-	kb.R[7] = kb.DA(instr)
+	kb.R[7] = kb.DA(instr).a
 }
 
 // RTS 00020R
@@ -508,15 +399,15 @@ func (kb *KB11) branch(instr uint16) {
 // JSR 004RDD
 func (kb *KB11) JSR(instr uint16) {
 	if ((instr >> 3) & 7) == 0 {
-		fmt.Printf("JSR called on register\n")
-		kb.printstate()
-		os.Exit(1)
+		// like JMP, an illegal instruction
+		kb.trap(INTBUS)
+		return
 	}
 	dst := kb.DA(instr)
 	reg := (instr >> 6) & 7
 	kb.push(kb.R[reg])
 	kb.R[reg] = kb.R[7]
-	kb.R[7] = dst
+	kb.R[7] = dst.a
 }
 
 // CLR 0050DD, CLRB 1050DD
@@ -746,7 +637,7 @@ func (kb *KB11) MARK(instr uint16) {
 	kb.R[5] = kb.pop()
 }
 
-// MFPI 0065SS
+// MFPI 0065SS, MFPD 1065SS
 func (kb *KB11) MFPI(instr uint16) {
 	var uval uint16
 	if !(instr&0x38 > 0) {
@@ -757,15 +648,15 @@ func (kb *KB11) MFPI(instr uint16) {
 			uval = kb.stackpointer[kb.previousmode()]
 		}
 	} else {
-		da := kb.DA(instr)
-		addr := kb.mmu.decode(false, da, kb.previousmode())
-		uval = kb.unibus.read16(addr)
+		// MFPD is a word instruction despite bit 15 being set
+		da := kb.ea(instr&077, 2)
+		uval = kb.readmode(da.a, kb.previousmode(), instr&0100000 > 0)
 	}
 	kb.push(uval)
 	kb.setNZ(2, uval)
 }
 
-// MTPI 0066DD
+// MTPI 0066DD, MTPD 1066DD
 func (kb *KB11) MTPI(instr uint16) {
 	uval := kb.pop()
 	if !(instr&0x38 > 0) {
@@ -775,13 +666,40 @@ func (kb *KB11) MTPI(instr uint16) {
 		} else {
 			kb.stackpointer[kb.previousmode()] = uval
 		}
-		da := kb.DA(instr)
-		addr := kb.mmu.decode(true, da, kb.previousmode())
-		kb.unibus.write16(addr, uval)
+	} else {
+		da := kb.ea(instr&077, 2)
+		kb.writemode(da.a, kb.previousmode(), instr&0100000 > 0, uval)
 	}
 	kb.setNZ(2, uval)
 }
 
+// MTPS 1064SS
+func (kb *KB11) MTPS(instr uint16) {
+	src := kb.read(1, kb.DA(instr))
+	if kb.currentmode() > 0 {
+		// outside kernel mode only the condition codes can be changed
+		kb.writePSW(kb.psw&0xfff0 | src&017)
+		return
+	}
+	// the T bit cannot be set with MTPS
+	kb.writePSW(kb.psw&0xff10 | src&0xef)
+}
+
+// MFPS 1067DD
+func (kb *KB11) MFPS(instr uint16) {
+	psw := kb.psw & 0xff
+	if !(instr&0x38 > 0) {
+		// Special case: mfps sign extends register to word size
+		if psw&0200 > 0 {
+			psw |= 0xff00
+		}
+		kb.R[instr&7] = psw
+	} else {
+		kb.write(1, kb.DA(instr), psw)
+	}
+	kb.setNZ(1, psw)
+}
+
 // SXT 0067DD
 func (kb *KB11) SXT(instr uint16) {
 	if kb.n() {
@@ -1050,56 +968,143 @@ func (kb *KB11) SOB(instr uint16) {
 func (kb *KB11) trapat(vec uint16) {
 	if vec&1 > 0 {
 		fmt.Printf("Thou darst calling trapat() with an odd vector number?\n")
-		os.Exit(1)
+		kb.halted = true
+		return
 	}
 
-	fmt.Printf("trap: vec: %03o\n", vec)
+	if kb.print {
+		fmt.Printf("trap: vec: %03o\n", vec)
+	}
 	if vec == 0220 {
 		//	kb.print = true
 	}
 
-	psw := kb.psw
+	// the vector is read from kernel space, the old PSW and PC are pushed
+	// on the stack of the mode selected by the new PSW.
+	psw, pc := kb.psw, kb.R[7]
 	kb.kernelmode()
-	kb.push(psw)
-	kb.push(kb.R[7])
-
 	kb.R[7] = kb.read16(vec)
-	kb.writePSW(kb.read16(vec+2) | (kb.previousmode() << 12))
+	kb.writePSW(kb.read16(vec+2)&^030000 | (psw>>2)&030000)
+	if kb.currentmode() == 0 && kb.has(featSTKLIM) {
+		switch kb.stackzone(kb.R[6] - 4) {
+		case stackyellow:
+			kb.yellow = true
+			kb.unibus.cpuerr |= CPUERRYELLOW
+		case stackred:
+			// use the emergency stack
+			kb.R[6] = 4
+			kb.unibus.cpuerr |= CPUERRRED
+		}
+	}
+	kb.R[6] -= 2
+	kb.write16(kb.R[6], psw)
+	kb.R[6] -= 2
+	kb.write16(kb.R[6], pc)
 }
 
+// fetch16 reads the word at the PC from instruction space and advances the PC.
 func (kb *KB11) fetch16() uint16 {
-	val := kb.read16(kb.R[7])
+	var val uint16
+	if a, ok := kb.mmu.cached(false, kb.R[7], kb.currentmode(), ispace); ok && !kb.abort {
+		// the readmode fast path, inlined
+		val = kb.unibus.core[a>>1]
+	} else {
+		val = kb.readspace(kb.R[7], ispace)
+	}
 	kb.R[7] += 2
 	return val
 }
 
 func (kb *KB11) push(v uint16) {
 	kb.R[6] -= 2
+	kb.mmu.record(6, -2)
+	kb.stackcheck(kb.R[6])
 	kb.write16(kb.R[6], v)
 }
 
+// Stack limit zones.
+const (
+	stackok     = iota // above the yellow zone
+	stackyellow        // the 16 words above the limit plus 340
+	stackred           // below the yellow zone
+)
+
+// stackzone returns the stack limit zone of the kernel stack address addr.
+func (kb *KB11) stackzone(addr uint16) int {
+	switch limit := uint32(kb.stacklimit); {
+	case uint32(addr) >= limit+0400:
+		return stackok
+	case uint32(addr) >= limit+0340:
+		return stackyellow
+	default:
+		return stackred
+	}
+}
+
+// stackcheck checks the kernel stack reference addr, a push or a write
+// through an autodecrement of R6, against the stack limit.
+// A reference in the yellow zone traps after the instruction completes.
+// A reference in the red zone aborts the instruction and traps using an
+// emergency stack at 4.
+func (kb *KB11) stackcheck(addr uint16) {
+	if kb.currentmode() > 0 || !kb.has(featSTKLIM) {
+		return
+	}
+	switch kb.stackzone(addr) {
+	case stackyellow:
+		kb.yellow = true
+		kb.unibus.cpuerr |= CPUERRYELLOW
+	case stackred:
+		kb.R[6] = 4
+		kb.unibus.cpuerr |= CPUERRRED
+		kb.trap(INTBUS)
+	}
+}
+
 func (kb *KB11) pop() uint16 {
 	val := kb.read16(kb.R[6])
 	kb.R[6] += 2
+	kb.mmu.record(6, 2)
 	return val
 }
 
-func (kb *KB11) SA(instr uint16) uint16 {
+func (kb *KB11) SA(instr uint16) operand {
 	// reconstruct L00SSDD as L0000SS
 	instr = (instr & (1 << 15)) | ((instr >> 6) & 077)
 	return kb.DA(instr)
 }
 
-func (kb *KB11) DA(instr uint16) uint16 {
+func (kb *KB11) DA(instr uint16) operand {
 	v := instr & 077
-	l := (2 - (instr >> 15))
-
-	if (v & 070) == 000 {
-		return 0170000 | (v & 7)
+	if v&070 == 0 {
+		// register operands are the most common
+		return operand{a: 0170000 | v}
 	}
+	l := (2 - (instr >> 15))
 	if ((v & 7) >= 6) || (v&010) > 0 {
 		l = 2
 	}
+	return kb.ea(v, l)
+}
+
+// An operand is the location of an instruction operand, either a general
+// register, encoded as 0170000 plus the register number, or an address in
+// instruction or data space.
+type operand struct {
+	a     uint16
+	d     bool // a is in data space
+	stack bool // a write checks the stack pointer against the stack limit
+}
+
+// ea returns the effective address of the operand specified by the six bit
+// mode and register field v, stepping autoincrement and autodecrement
+// registers by l.
+// Immediate operands are in instruction space, as are the addresses of
+// absolute operands, everything else is in data space.
+func (kb *KB11) ea(v, l uint16) operand {
+	if (v & 070) == 000 {
+		return operand{a: 0170000 | (v & 7)}
+	}
 	var addr uint16
 	switch v & 060 {
 	case 000:
@@ -1108,52 +1113,120 @@ func (kb *KB11) DA(instr uint16) uint16 {
 	case 020:
 		addr = kb.R[v&7]
 		kb.R[v&7] += l
+		kb.mmu.record(v&7, int16(l))
 	case 040:
 		kb.R[v&7] -= l
+		kb.mmu.record(v&7, -int16(l))
 		addr = kb.R[v&7]
 	case 060:
 		addr = kb.fetch16()
 		addr += kb.R[v&7]
 	}
-	if v&010 > 0 {
+	// R6 is left as it was autodecremented until the operand is written
+	op := operand{d: v != 027, stack: v&067 == 046}
+	switch {
+	case v == 037:
+		addr = kb.readspace(addr, ispace)
+	case v&010 > 0:
 		addr = kb.read16(addr)
 	}
-	return addr
+	op.a = addr
+	return op
 }
 
-func (kb *KB11) read(l int, a uint16) uint16 {
+// read reads the operand op, which was returned from DA or SA.
+func (kb *KB11) read(l int, op operand) uint16 {
+	a := op.a
 	if (a & 0177770) == 0170000 {
 		return kb.R[a&7] & max(l)
 	}
 	if l == 2 {
-		return kb.read16(a)
+		return kb.readspace(a, op.d)
 	}
 	switch a & 1 {
 	case 1:
-		return kb.read16(a&^1) >> 8
+		return kb.readspace(a&^1, op.d) >> 8
 	default:
-		return kb.read16(a) & 0xFF
+		return kb.readspace(a, op.d) & 0xFF
 	}
 }
 
-func (kb *KB11) read16(va uint16) uint16 {
-	a := kb.mmu.decode(false, va, kb.currentmode())
+// read16 reads the word at va from data space.
+func (kb *KB11) read16(va uint16) uint16 { return kb.readspace(va, dspace) }
+
+// peek returns the word at va in instruction or data space of the current
+// mode for inspection. It has no side effects, so only memory can be read.
+// If va can not be mapped, or maps to anything but memory, peek returns
+// false.
+func (kb *KB11) peek(va uint16, d bool) (uint16, bool) {
+	a, reason := kb.mmu.translate(false, va, kb.currentmode(), d)
+	if reason != 0 || a&1 == 1 || a >= kb.unibus.memtop() {
+		return 0, false
+	}
+	return kb.unibus.core[a>>1], true
+}
+
+// readspace reads the word at va from instruction or data space.
+func (kb *KB11) readspace(va uint16, d bool) uint16 {
+	return kb.readmode(va, kb.currentmode(), d)
+}
+
+// readmode reads the word at va from instruction or data space of mode.
+// If the read traps zero is returned and the instruction is aborted.
+func (kb *KB11) readmode(va, mode uint16, d bool) uint16 {
+	if kb.abort {
+		return 0
+	}
+	if a, ok := kb.mmu.cached(false, va, mode, d); ok {
+		return kb.unibus.core[a>>1]
+	}
+	if va&1 == 1 {
+		kb.unibus.cpuerr |= CPUERRODD
+		kb.trap(INTBUS)
+		return 0
+	}
+	a, ok := kb.mmu.decode(false, va, mode, d)
+	if !ok {
+		if kb.print {
+			fmt.Printf("mmu::decode abort read %06o, SR0 %06o\n", va, kb.mmu.SR0)
+		}
+		kb.trap(INTFAULT)
+		return 0
+	}
+	if a&1 == 0 && a < kb.unibus.memtop() {
+		// most reads are from memory
+		kb.mmu.cache(false, va, mode, d, kb.unibus.memtop())
+		return kb.unibus.core[a>>1]
+	}
+	if a >= iopage && !kb.implemented(a) {
+		if kb.print {
+			fmt.Printf("kb11: read from unimplemented register %08o\n", a)
+		}
+		kb.unibus.cpuerr |= CPUERRTIMEOUT
+		kb.trap(INTBUS)
+		return 0
+	}
 	switch a {
-	case 0777776:
+	case 017777776:
 		return kb.psw
-	case 0777774:
+	case 017777774:
 		return kb.stacklimit
-	case 0777570:
-		return 0173030 // kb.switchregister
+	case 017777772:
+		return kb.readpirq()
+	case 017777570:
+		return kb.switchregister
 	default:
-		if a == 0140000 {
-			kb.printstate()
+		v, ok := kb.unibus.read16(a)
+		if !ok {
+			kb.trap(INTBUS)
 		}
-		return kb.unibus.read16(a)
+		return v
 	}
 }
 
-func (kb *KB11) write(l int, a, v uint16) {
+// write writes the operand op, which was returned from DA.
+func (kb *KB11) write(l int, op operand, v uint16) {
+	a := op.a
 	if (a & 0177770) == 0170000 {
 		r := a & 7
 		if l == 2 {
@@ -1164,34 +1237,86 @@ func (kb *KB11) write(l int, a, v uint16) {
 		}
 		return
 	}
+	if op.stack {
+		kb.stackcheck(kb.R[6])
+	}
 	if l == 2 {
-		kb.write16(a, v)
+		kb.writespace(a, op.d, v)
 		return
 	}
 	switch a & 1 {
 	case 1:
-		mem := v<<8 | kb.read16(a&^1)&0xff
-		kb.write16(a&^1, mem)
+		mem := v<<8 | kb.readspace(a&^1, op.d)&0xff
+		kb.writespace(a&^1, op.d, mem)
 	default:
-		mem := kb.read16(a)&0xff00 | v&0xff
-		kb.write16(a, mem)
+		mem := kb.readspace(a, op.d)&0xff00 | v&0xff
+		kb.writespace(a, op.d, mem)
 	}
 }
 
-func (kb *KB11) write16(va, v uint16) {
-	a := kb.mmu.decode(true, va, kb.currentmode())
+// write16 writes v to the word at va in data space.
+func (kb *KB11) write16(va, v uint16) { kb.writespace(va, dspace, v) }
+
+// writespace writes v to the word at va in instruction or data space.
+func (kb *KB11) writespace(va uint16, d bool, v uint16) {
+	kb.writemode(va, kb.currentmode(), d, v)
+}
+
+// writemode writes v to the word at va in instruction or data space of mode.
+// If the write traps memory is unchanged and the instruction is aborted.
+func (kb *KB11) writemode(va, mode uint16, d bool, v uint16) {
+	if kb.abort {
+		return
+	}
+	if a, ok := kb.mmu.cached(true, va, mode, d); ok {
+		kb.unibus.core[a>>1] = v
+		return
+	}
+	if va&1 == 1 {
+		// the odd address aborts the write before the page is marked
+		// written
+		kb.unibus.cpuerr |= CPUERRODD
+		kb.trap(INTBUS)
+		return
+	}
+	a, ok := kb.mmu.decode(true, va, mode, d)
+	if !ok {
+		if kb.print {
+			fmt.Printf("mmu::decode abort write %06o, SR0 %06o\n", va, kb.mmu.SR0)
+		}
+		kb.trap(INTFAULT)
+		return
+	}
+	if a&1 == 0 && a < kb.unibus.memtop() {
+		// most writes are to memory
+		kb.mmu.cache(true, va, mode, d, kb.unibus.memtop())
+		kb.unibus.core[a>>1] = v
+		return
+	}
+	if a >= iopage && !kb.implemented(a) {
+		if kb.print {
+			fmt.Printf("kb11: write to unimplemented register %08o\n", a)
+		}
+		kb.unibus.cpuerr |= CPUERRTIMEOUT
+		kb.trap(INTBUS)
+		return
+	}
 	switch a {
-	case 0777776:
-		kb.writePSW(v)
-	case 0777774:
-		kb.stacklimit = v
-	case 0777570:
+	case 017777776:
+		// the T bit can only be set by a trap or RTI and RTT
+		kb.writePSW(v&^PSWT | kb.psw&PSWT)
+	case 017772516:
+		kb.unibus.write16(a, v&kb.sr3mask())
+	case 017777774:
+		kb.stacklimit = v & 0177400
+	case 017777772:
+		kb.pirq = v & 0177000
+	case 017777570:
 		kb.displayregister = v
 	default:
-		if a == 0140000 {
-			kb.printstate()
+		if !kb.unibus.write16(a, v) {
+			kb.trap(INTBUS)
 		}
-		kb.unibus.write16(a, v)
 	}
 }
 
@@ -1227,11 +1352,22 @@ func (kb *KB11) setNZC(l int, v uint16) {
 }
 
 func (kb *KB11) writePSW(psw uint16) {
+	if !kb.has(featREGSET) {
+		psw &^= PSWREGSET
+	}
+	if (psw^kb.psw)&PSWREGSET > 0 {
+		// switch general register sets
+		copy(kb.registerset[kb.psw>>11&1][:], kb.R[:6])
+		copy(kb.R[:6], kb.registerset[psw>>11&1][:])
+	}
 	kb.stackpointer[kb.currentmode()] = kb.R[6]
 	kb.psw = psw
 	kb.R[6] = kb.stackpointer[kb.currentmode()]
 }
 
+// modes are the single letter names of the cpu modes.
+var modes = [...]string{"K", "S", "?", "U"}
+
 // currentmode returns the current cpu mode.
 // 0: kernel, 1: supervisor, 2: illegal, 3: user
 func (kb *KB11) currentmode() uint16 { return kb.psw >> 14 }
@@ -1250,6 +1386,9 @@ const (
 	FLAGV = 2
 	FLAGZ = 4
 	FLAGN = 8
+
+	PSWT      = 1 << 4  // trace trap
+	PSWREGSET = 1 << 11 // general register set 1 selected
 )
 
 func (kb *KB11) n() bool { return kb.psw&FLAGN == FLAGN }
@@ -1259,21 +1398,11 @@ func (kb *KB11) c() bool { return kb.psw&FLAGC == FLAGC }
 
 func (kb *KB11) printstate() {
 	prev := func() string {
-		switch kb.previousmode() {
-		case 3:
-			return "u"
-		default:
-			return "k"
-		}
+		return strings.ToLower(modes[kb.previousmode()])
 	}
 
 	curr := func() string {
-		switch kb.currentmode() {
-		case 3:
-			return "U"
-		default:
-			return "K"
-		}
+		return modes[kb.currentmode()]
 	}
 
 	n := func() string {
@@ -1307,7 +1436,7 @@ func (kb *KB11) printstate() {
 	fmt.Printf("R0 %06o R1 %06o R2 %06o R3 %06o R4 %06o R5 %06o R6 %06o R7 %06o\n",
 		kb.R[0], kb.R[1], kb.R[2], kb.R[3], kb.R[4], kb.R[5], kb.R[6], kb.R[7])
 	fmt.Printf("[%s%s%s%s%s%s", prev(), curr(), n(), z(), v(), c())
-	fmt.Printf("]  instr %06o: %06o\t ", kb.pc, kb.read16(kb.pc))
+	fmt.Printf("]  instr %06o: %06o\t ", kb.pc, kb.disasmword(kb.pc))
 	kb.disasm(kb.pc)
 	fmt.Println()
 }
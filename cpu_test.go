@@ -2,6 +2,7 @@ package main
 
 import (
 	"testing"
+	"time"
 
 	"github.com/matryer/is"
 )
@@ -142,7 +143,7 @@ func TestCMP(t *testing.T) {
 	// bug found in early v6 unix boot
 	cpu.R[1] = 0137000
 	cpu.R[7] = 0000032
-	cpu.Load(addr18(cpu.R[7]), 0020701) // CMP PC, R1
+	cpu.Load(addr22(cpu.R[7]), 0020701) // CMP PC, R1
 	cpu.step()
 
 	is.Equal(cpu.R[1], uint16(0137000))
@@ -542,6 +543,356 @@ func TestSXT(t *testing.T) {
 	}
 }
 
+func TestMTPS(t *testing.T) {
+	is := is.New(t)
+
+	var cpu KB11
+	cpu.Load(002000, 0106400) // MTPS R0
+	cpu.R[0] = 0177757
+	cpu.R[7] = 002000
+	cpu.step()
+	is.Equal(cpu.psw, uint16(0357)) // T bit cannot be set
+
+	cpu.psw = 0170000 // user mode
+	cpu.R[0] = 0000357
+	cpu.R[7] = 002000
+	cpu.step()
+	is.Equal(cpu.psw, uint16(0170017)) // only condition codes change
+}
+
+func TestMFPS(t *testing.T) {
+	is := is.New(t)
+
+	var cpu KB11
+	cpu.Load(002000, 0106700) // MFPS R0
+	cpu.psw = 0000210
+	cpu.R[0] = 0
+	cpu.R[7] = 002000
+	cpu.step()
+	is.Equal(cpu.R[0], uint16(0177610)) // sign extended
+	is.Equal(cpu.n(), true)
+	is.Equal(cpu.z(), false)
+	is.Equal(cpu.v(), false)
+
+	cpu.Load(002000, 0106737, 0003001) // MFPS @#3001
+	cpu.psw = 0000340
+	cpu.R[7] = 002000
+	cpu.step()
+	is.Equal(cpu.unibus.core[03000>>1], uint16(0160000))
+	is.Equal(cpu.n(), true)
+}
+
+func TestMFPDMTPD(t *testing.T) {
+	is := is.New(t)
+
+	var cpu KB11
+	cpu.Load(002000,
+		0106520, // MFPD (R0)+
+		0106621, // MTPD (R1)+
+	)
+	cpu.Load(003000, 0123456)
+	cpu.R[0] = 003000
+	cpu.R[1] = 003002
+	cpu.R[6] = 001000
+	cpu.R[7] = 002000
+	cpu.step()
+	is.Equal(cpu.R[0], uint16(003002)) // word increment
+	is.Equal(cpu.R[6], uint16(000776))
+	cpu.step()
+	is.Equal(cpu.R[1], uint16(003004))
+	is.Equal(cpu.R[6], uint16(001000))
+	is.Equal(cpu.unibus.core[03002>>1], uint16(0123456))
+	is.Equal(cpu.n(), true)
+}
+
+func TestTrapSupervisor(t *testing.T) {
+	is := is.New(t)
+
+	var cpu KB11
+	cpu.Load(000034, 003000, 0040000) // TRAP vector, supervisor mode
+	cpu.Load(002000, 0104400)         // TRAP
+	cpu.Load(003000, 0000006)         // RTT
+	cpu.psw = 0170000
+	cpu.R[6] = 001000
+	cpu.stackpointer[0] = 000600
+	cpu.stackpointer[1] = 000700
+	cpu.R[7] = 002000
+	cpu.step()
+	is.Equal(cpu.currentmode(), uint16(1))
+	is.Equal(cpu.previousmode(), uint16(3))
+	is.Equal(cpu.R[6], uint16(000674)) // supervisor stack
+	is.Equal(cpu.unibus.core[0676>>1], uint16(0170000))
+	is.Equal(cpu.unibus.core[0674>>1], uint16(002002))
+	is.Equal(cpu.stackpointer[3], uint16(001000))
+
+	cpu.step()
+	is.Equal(cpu.currentmode(), uint16(3))
+	is.Equal(cpu.R[6], uint16(001000))
+	is.Equal(cpu.R[7], uint16(002002))
+}
+
+func TestRTTSupervisor(t *testing.T) {
+	is := is.New(t)
+
+	var cpu KB11
+	cpu.Load(000674, 002000, 0000017) // PC, PSW kernel mode, priority 0
+	cpu.Load(003000, 0000002)         // RTI
+	cpu.psw = 0050340                 // supervisor, previous supervisor, priority 7
+	cpu.R[6] = 000674
+	cpu.R[7] = 003000
+	cpu.step()
+	is.Equal(cpu.psw, uint16(0050357)) // mode and priority unchanged
+	is.Equal(cpu.R[6], uint16(000700))
+	is.Equal(cpu.R[7], uint16(002000))
+}
+
+func TestStackLimit(t *testing.T) {
+	is := is.New(t)
+
+	var cpu KB11
+	cpu.stacklimit = 001000
+	cpu.Load(002000, 0010046) // MOV R0, -(SP)
+
+	cpu.R[0] = 0123456
+	cpu.R[6] = 001402
+	cpu.R[7] = 002000
+	cpu.step()
+	is.Equal(cpu.yellow, false)
+
+	cpu.R[6] = 001400
+	cpu.R[7] = 002000
+	cpu.step()
+	is.Equal(cpu.yellow, true) // yellow zone, the write completes
+	is.Equal(cpu.unibus.core[01376>>1], uint16(0123456))
+
+	cpu.yellow = false
+	cpu.R[6] = 001340
+	cpu.R[7] = 002000
+	cpu.step()
+	is.True(cpu.abort)
+	is.Equal(cpu.saved.vec, uint16(INTBUS))
+	is.Equal(cpu.saved.R[6], uint16(4)) // red zone, emergency stack
+	is.Equal(cpu.unibus.core[01336>>1], uint16(0))
+	is.Equal(cpu.unibus.cpuerr&CPUERRRED, uint16(CPUERRRED))
+
+	// reads are not checked
+	cpu.abort = false
+	cpu.Load(002000, 0005746) // TST -(SP)
+	cpu.R[6] = 001340
+	cpu.R[7] = 002000
+	cpu.step()
+	is.True(!cpu.abort)
+	is.Equal(cpu.R[6], uint16(001336))
+
+	// the pushes of a trap are checked too, a yellow zone trap follows
+	// the trap and does not trap again itself
+	cpu.unibus.cpuerr = 0
+	cpu.Load(000004, 003000, 0000340) // bus error vector
+	cpu.Load(000034, 004000, 0000340) // TRAP vector
+	cpu.Load(002000, 0104400)         // TRAP
+	cpu.R[6] = 001400
+	cpu.R[7] = 002000
+	cpu.step()
+	cpu.traps()
+	is.Equal(cpu.R[7], uint16(003000))
+	is.Equal(cpu.R[6], uint16(001370))
+	is.Equal(cpu.unibus.core[001370>>1], uint16(004000))
+	is.True(!cpu.yellow)
+	is.Equal(cpu.unibus.cpuerr, uint16(CPUERRYELLOW))
+
+	// a trap into the red zone uses the emergency stack
+	cpu.unibus.cpuerr = 0
+	cpu.R[6] = 001300
+	cpu.R[7] = 002000
+	cpu.step()
+	is.Equal(cpu.R[7], uint16(004000))
+	is.Equal(cpu.R[6], uint16(0))
+	is.Equal(cpu.unibus.cpuerr, uint16(CPUERRRED))
+
+	// the stack is not checked on a model without a stack limit register
+	cpu.model = models["11/20"]
+	cpu.Load(002000, 0010046) // MOV R0, -(SP)
+	cpu.R[6] = 001340
+	cpu.R[7] = 002000
+	cpu.step()
+	is.True(!cpu.abort)
+	is.Equal(cpu.unibus.core[01336>>1], uint16(0123456))
+}
+
+// steptrap runs the instruction at 2000 and returns the vector of the trap
+// it raises, or zero.
+func steptrap(cpu *KB11) uint16 {
+	cpu.R[7] = 002000
+	cpu.step()
+	if !cpu.abort {
+		return 0
+	}
+	cpu.abort = false
+	return cpu.saved.vec
+}
+
+func TestModel(t *testing.T) {
+	is := is.New(t)
+
+	cpu := KB11{model: models["11/20"]}
+	cpu.Load(002000, 0070001) // MUL R1, R0
+	is.Equal(steptrap(&cpu), uint16(INTINVAL))
+
+	cpu = KB11{model: models["11/40"]}
+	cpu.Load(002000, 0070001) // MUL R1, R0
+	is.Equal(steptrap(&cpu), uint16(0))
+	cpu.Load(002000, 0170011) // SETD
+	is.Equal(steptrap(&cpu), uint16(INTINVAL))
+	cpu.Load(002000, 0005737, 0177774) // TST @#177774
+	is.Equal(steptrap(&cpu), uint16(INTBUS))
+
+	cpu = KB11{model: models["11/45"]}
+	cpu.Load(002000, 0005737, 0177774) // TST @#177774
+	is.Equal(steptrap(&cpu), uint16(0))
+	cpu.Load(002000, 0005737, 0177766) // TST @#177766
+	is.Equal(steptrap(&cpu), uint16(INTBUS))
+	cpu.Load(002000, 0000007) // MFPT
+	is.Equal(steptrap(&cpu), uint16(INTINVAL))
+
+	cpu = KB11{model: models["11/44"]}
+	cpu.Load(002000, 0000007) // MFPT
+	is.Equal(steptrap(&cpu), uint16(0))
+	is.Equal(cpu.R[0], uint16(1))
+}
+
+func TestRegisterSet(t *testing.T) {
+	is := is.New(t)
+
+	var cpu KB11
+	cpu.Load(000034, 003000, 0004000)           // TRAP vector, register set 1
+	cpu.Load(002000, 0104400)                   // TRAP
+	cpu.Load(003000, 0012700, 0000002, 0000002) // MOV #2, R0; RTI
+	cpu.R[0] = 1
+	cpu.R[6] = 001000
+	cpu.R[7] = 002000
+	cpu.step()
+	is.Equal(cpu.R[0], uint16(0))
+	is.Equal(cpu.R[6], uint16(000774)) // R6 is shared
+	cpu.step()
+	is.Equal(cpu.R[0], uint16(2))
+	cpu.step()
+	is.Equal(cpu.psw&PSWREGSET, uint16(0))
+	is.Equal(cpu.R[0], uint16(1))
+	cpu.writePSW(PSWREGSET)
+	is.Equal(cpu.R[0], uint16(2))
+
+	cpu = KB11{model: models["11/40"]}
+	cpu.writePSW(PSWREGSET)
+	is.Equal(cpu.psw, uint16(0))
+}
+
+func TestPIRQ(t *testing.T) {
+	is := is.New(t)
+
+	var cpu KB11
+	cpu.Load(000240, 003000, 0000340)           // PIRQ vector, priority 7
+	cpu.Load(002000, 0012737, 0011000, 0177772) // MOV #11000, @#177772
+	cpu.R[6] = 001000
+	cpu.R[7] = 002000
+	cpu.writePSW(5 << 5)
+	cpu.step()
+	is.Equal(cpu.readspace(0177772, dspace), uint16(0011000|4<<5|4<<1)) // levels 4 and 1, level 4 encoded
+
+	// level 4 is below the cpu priority
+	cpu.takeinterrupt()
+	is.Equal(cpu.R[7], uint16(002006))
+
+	cpu.writePSW(3 << 5)
+	cpu.takeinterrupt()
+	is.Equal(cpu.R[7], uint16(003000))
+	is.Equal(cpu.priority(), uint16(7))
+	is.Equal(cpu.read16(cpu.R[6]+2), uint16(3<<5))
+}
+
+func TestRESET(t *testing.T) {
+	is := is.New(t)
+
+	var cpu KB11
+	cpu.unibus.mmu = &cpu.mmu
+	cpu.Load(017772300, 077406)                 // KIPDR0
+	cpu.Load(017777572, SR0ENABLE)              // MMR0, enable the mmu
+	cpu.Load(017772516, SR3KDS)                 // MMR3
+	cpu.Load(002000, 0000005, 0013700, 0002000) // RESET; MOV @#2000, R0
+	cpu.pirq = 0001000
+	cpu.stacklimit = 0000400
+	cpu.queueinterrupt(interrupt{INTRK, 5})
+	cpu.unibus.cpuerr = CPUERRNXM
+	cpu.R[7] = 002000
+	cpu.step()
+	is.Equal(cpu.mmu.SR0, uint16(0))
+	is.Equal(cpu.mmu.SR3, uint16(0))
+	is.Equal(cpu.pirq, uint16(0))
+	is.Equal(cpu.stacklimit, uint16(0))
+	is.Equal(cpu.interrupts[0], interrupt{})
+	is.Equal(cpu.unibus.cpuerr, uint16(0))
+
+	// the tlb is flushed with the mmu off
+	_, ok := cpu.mmu.cached(false, 002000, 0, dspace)
+	is.True(!ok)
+	cpu.step()
+	is.Equal(cpu.R[0], uint16(0000005))
+}
+
+func TestCPUError(t *testing.T) {
+	is := is.New(t)
+
+	var cpu KB11
+	cpu.unibus.memsize = 0100000
+	cpu.Load(002000, 0013700, 0001001) // MOV @#1001, R0
+	is.Equal(steptrap(&cpu), uint16(INTBUS))
+	is.Equal(cpu.unibus.cpuerr, uint16(CPUERRODD))
+
+	cpu.Load(002000, 0105737, 0001001) // TSTB @#1001
+	is.Equal(steptrap(&cpu), uint16(0))
+
+	cpu.Load(002000, 0005737, 0120000) // TST @#120000
+	is.Equal(steptrap(&cpu), uint16(INTBUS))
+	cpu.Load(002000, 0005737, 0177000) // TST @#177000
+	is.Equal(steptrap(&cpu), uint16(INTBUS))
+	cpu.Load(002000, 0013700, 0177766) // MOV @#177766, R0
+	is.Equal(steptrap(&cpu), uint16(0))
+	is.Equal(cpu.R[0], uint16(CPUERRODD|CPUERRNXM|CPUERRTIMEOUT))
+
+	cpu.Load(002000, 0005037, 0177766) // CLR @#177766
+	is.Equal(steptrap(&cpu), uint16(0))
+	is.Equal(cpu.unibus.cpuerr, uint16(0))
+
+	cpu.writePSW(0140000)
+	cpu.Load(002000, 0000000) // HALT
+	is.Equal(steptrap(&cpu), uint16(INTBUS))
+	is.Equal(cpu.unibus.cpuerr, uint16(CPUERRHALT))
+
+	// an odd address aborts a write before the page is marked written
+	cpu.writePSW(0)
+	cpu.unibus.cpuerr = 0
+	cpu.mmu.write16(0772300, 077406) // KIPDR0
+	cpu.mmu.SR0 = SR0ENABLE
+	cpu.Load(002000, 0010037, 0001001) // MOV R0, @#1001
+	is.Equal(steptrap(&cpu), uint16(INTBUS))
+	is.Equal(cpu.unibus.cpuerr, uint16(CPUERRODD))
+	is.Equal(cpu.mmu.pages[0][0].pdr, uint16(077406))
+}
+
+func TestJMPRegister(t *testing.T) {
+	is := is.New(t)
+
+	var cpu KB11
+	cpu.writePSW(0170000)
+	cpu.Load(002000, 0000100) // JMP R0
+	is.Equal(steptrap(&cpu), uint16(INTBUS))
+	is.True(!cpu.halted)
+	is.Equal(cpu.saved.R[7], uint16(002002))
+
+	cpu.Load(002000, 0004700) // JSR R7, R0
+	is.Equal(steptrap(&cpu), uint16(INTBUS))
+	is.True(!cpu.halted)
+}
+
 func TestTST(t *testing.T) {
 	is := is.New(t)
 
@@ -1019,3 +1370,302 @@ func BenchmarkNEGB(b *testing.B) {
 		cpu.step()
 	}
 }
+
+// BenchmarkBootLoop boots a synthetic RK05 image with the bootrom. Block 0
+// of the image holds a program which copies memory and calls a subroutine
+// in a loop before halting, it is not an operating system.
+func BenchmarkBootLoop(b *testing.B) {
+	boot := []uint16{
+		0012706, 0001000, // MOV #1000, SP
+		0012702, 0000100, // MOV #100, R2
+		0012700, 0010000, // 10: MOV #10000, R0
+		0012701, 0020000, // MOV #20000, R1
+		0012703, 0001000, // MOV #1000, R3
+		0012021,          // 24: MOV (R0)+, (R1)+
+		0060405,          // ADD R4, R5
+		0005104,          // COM R4
+		0077304,          // SOB R3, 24
+		0004767, 0000006, // JSR PC, 46
+		0077215, // SOB R2, 10
+		0000000, // HALT
+		0000000,
+		0010546, // 46: MOV R5, -(SP)
+		0012605, // MOV (SP)+, R5
+		0000207, // RTS PC
+	}
+	image := make([]byte, 1024) // the bootrom reads two blocks
+	for i, w := range boot {
+		image[i*2] = byte(w)
+		image[i*2+1] = byte(w >> 8)
+	}
+
+	var cpu KB11
+	cpu.unibus.rk11.unibus = &cpu.unibus
+	cpu.unibus.mmu = &cpu.mmu
+	cpu.unibus.rk11.units[0].buf = image
+	cpu.Reset()
+	cpu.Load(0002000, bootrom[:]...)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cpu.R[7] = 0002002
+		cpu.halted = false
+		cpu.run()
+		if cpu.R[7] != 044 {
+			b.Fatalf("halted at %06o", cpu.R[7])
+		}
+	}
+}
+
+// benchcopy steps the loop of the BenchmarkBootLoop program, which copies
+// memory and calls a subroutine, with memory management on or off.
+func benchcopy(b *testing.B, mmu bool) {
+	var cpu KB11
+	cpu.unibus.mmu = &cpu.mmu
+	cpu.Load(0000000,
+		0012706, 0001000, // MOV #1000, SP
+		0012702, 0000100, // MOV #100, R2
+		0012700, 0010000, // 10: MOV #10000, R0
+		0012701, 0020000, // MOV #20000, R1
+		0012703, 0001000, // MOV #1000, R3
+		0012021,          // 24: MOV (R0)+, (R1)+
+		0060405,          // ADD R4, R5
+		0005104,          // COM R4
+		0077304,          // SOB R3, 24
+		0004767, 0000006, // JSR PC, 46
+		0000763, // BR 10
+		0000000,
+		0000000,
+		0010546, // 46: MOV R5, -(SP)
+		0012605, // MOV (SP)+, R5
+		0000207, // RTS PC
+	)
+	if mmu {
+		for i := addr22(0); i < 8; i++ {
+			cpu.Load(017772300+i*2, 077406)         // KIPDRi
+			cpu.Load(017772340+i*2, uint16(i*0200)) // KIPARi
+		}
+		cpu.Load(017772356, 07600) // KIPAR7, the I/O page
+		cpu.Load(017777572, 1)     // MMR0, enable the mmu
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cpu.step()
+	}
+	if cpu.abort || cpu.halted {
+		b.Fatalf("trapped at %06o", cpu.R[7])
+	}
+}
+
+func BenchmarkCopy(b *testing.B)    { benchcopy(b, false) }
+func BenchmarkCopyMMU(b *testing.B) { benchcopy(b, true) }
+
+func TestQueueInterrupt(t *testing.T) {
+	is := is.New(t)
+	var cpu KB11
+	cpu.queueinterrupt(interrupt{})
+	cpu.queueinterrupt(interrupt{INTTTYIN, 4})
+	cpu.queueinterrupt(interrupt{INTCLOCK, 6})
+	cpu.queueinterrupt(interrupt{INTRK, 5})
+	cpu.queueinterrupt(interrupt{INTTTYOUT, 4})
+	is.Equal(cpu.interrupts[:5], []interrupt{
+		{INTCLOCK, 6},
+		{INTRK, 5},
+		{INTTTYIN, 4},
+		{INTTTYOUT, 4},
+		{},
+	})
+
+	// a pending vector is queued once
+	cpu.queueinterrupt(interrupt{INTRK, 5})
+	is.Equal(cpu.interrupts[:5], []interrupt{
+		{INTCLOCK, 6},
+		{INTRK, 5},
+		{INTTTYIN, 4},
+		{INTTTYOUT, 4},
+		{},
+	})
+}
+
+func TestInterruptAbort(t *testing.T) {
+	is := is.New(t)
+
+	var cpu KB11
+	cpu.unibus.memsize = 0100000
+	cpu.Load(000004, 003000, 0000340) // bus error vector
+	cpu.Load(000220, 004000, 0000240) // RK11 vector
+	cpu.R[6] = 0120000                // non-existent memory
+	cpu.R[7] = 002000
+	cpu.queueinterrupt(interrupt{INTRK, 5})
+	cpu.takeinterrupt()
+	is.True(cpu.abort)
+
+	// the bus error is taken from the interrupted state, using the
+	// emergency stack, and the interrupt stays pending
+	cpu.aborttrap()
+	is.Equal(cpu.R[7], uint16(003000))
+	is.Equal(cpu.read16(0), uint16(002000))
+	is.Equal(cpu.read16(2), uint16(0))
+	is.Equal(cpu.interrupts[0], interrupt{INTRK, 5})
+	is.Equal(cpu.unibus.cpuerr&CPUERRRED, uint16(CPUERRRED)) // a fatal stack error
+
+	// a trap which fails on the emergency stack halts the cpu
+	cpu.unibus.mmu = &cpu.mmu
+	cpu.Load(017777572, SR0ENABLE) // every page is non-resident
+	cpu.trap(INTINVAL)
+	cpu.aborttrap()
+	is.True(cpu.halted)
+	is.True(!cpu.abort)
+	is.Equal(cpu.unibus.cpuerr&CPUERRRED, uint16(CPUERRRED))
+}
+
+func TestTraceTrap(t *testing.T) {
+	is := is.New(t)
+
+	var cpu KB11
+	cpu.Load(000014, 003000, 0000340) // trace trap vector
+	cpu.Load(002000, 0000240)         // NOP
+	cpu.Load(002100, 0000002)         // RTI
+	cpu.Load(002200, 0000006)         // RTT
+	cpu.R[6] = 001000
+	cpu.R[7] = 002000
+	cpu.psw = PSWT
+	cpu.step()
+	cpu.traps()
+	is.Equal(cpu.R[7], uint16(003000))
+	is.Equal(cpu.R[6], uint16(000774))
+	is.Equal(cpu.read16(000774), uint16(002002))
+	is.Equal(cpu.read16(000776), uint16(PSWT))
+
+	// RTI setting T traps after the RTI
+	cpu.Load(000774, 002000, PSWT)
+	cpu.R[7] = 002100
+	cpu.step()
+	cpu.traps()
+	is.Equal(cpu.R[7], uint16(003000))
+	is.Equal(cpu.read16(000774), uint16(002000))
+
+	// RTT setting T traps after the next instruction
+	cpu.R[7] = 002200
+	cpu.step()
+	cpu.traps()
+	is.Equal(cpu.R[7], uint16(002000))
+	is.Equal(cpu.psw, uint16(PSWT))
+	cpu.step()
+	cpu.traps()
+	is.Equal(cpu.R[7], uint16(003000))
+	is.Equal(cpu.read16(000774), uint16(002002))
+
+	// writing the PSW does not change T
+	cpu.Load(002000, 0012737, PSWT, 0177776) // MOV #20, @#177776
+	cpu.psw = 0
+	cpu.R[7] = 002000
+	cpu.step()
+	is.Equal(cpu.psw, uint16(0))
+}
+
+func TestTrapPriority(t *testing.T) {
+	is := is.New(t)
+
+	var cpu KB11
+	cpu.Load(000004, 004000, 0000340) // bus error vector
+	cpu.Load(000014, 003000, 0000340) // trace trap vector
+	cpu.Load(000250, 005000, 0000340) // memory management vector
+	cpu.R[6] = 001000
+	cpu.R[7] = 002002
+	cpu.mmu.trap = true
+	cpu.yellow = true
+	cpu.trace = true
+	cpu.traps()
+	is.Equal(cpu.R[7], uint16(003000)) // trace is taken last
+	is.Equal(cpu.R[6], uint16(000764))
+	is.Equal(cpu.read16(000764), uint16(004000))
+	is.Equal(cpu.read16(000770), uint16(005000))
+	is.Equal(cpu.read16(000774), uint16(002002))
+
+	// a trap which aborts suppresses the trace trap
+	cpu.unibus.memsize = 0100000
+	cpu.R[6] = 0120000 // non-existent memory
+	cpu.R[7] = 002002
+	cpu.mmu.trap = true
+	cpu.trace = true
+	cpu.traps()
+	is.True(cpu.abort)
+	is.Equal(cpu.saved.vec, uint16(INTBUS))
+	is.True(!cpu.trace)
+}
+
+func TestWAIT(t *testing.T) {
+	is := is.New(t)
+
+	var cpu KB11
+	cpu.Load(000060, 003000, 0000200) // console input vector
+	cpu.Load(002000, 0000001)         // WAIT
+	cpu.R[6] = 001000
+	cpu.R[7] = 002000
+	cpu.writePSW(4 << 5)
+	cpu.step()
+	is.True(cpu.waiting)
+	is.Equal(cpu.R[7], uint16(002002))
+
+	// an interrupt at the cpu priority does not end the WAIT
+	cpu.queueinterrupt(interrupt{INTTTYIN, 4})
+	cpu.takeinterrupt()
+	is.True(cpu.waiting)
+
+	cpu.writePSW(0)
+	cpu.takeinterrupt()
+	is.True(!cpu.waiting)
+	is.Equal(cpu.R[7], uint16(003000))
+	is.Equal(cpu.read16(000774), uint16(002002))
+
+	// WAIT is a no-op in user mode
+	cpu.writePSW(0140000)
+	cpu.R[7] = 002000
+	cpu.step()
+	is.True(!cpu.waiting)
+}
+
+func TestWAITBusy(t *testing.T) {
+	is := is.New(t)
+
+	var cpu KB11
+	rk := &cpu.unibus.rk11
+	rk.unibus = &cpu.unibus
+	rk.units[0].buf = rkimage(0313*24, 0)
+	rk.reset()
+
+	// the devices are busy while a character is transmitted or a drive
+	// seeks, but not once the drive waits for search complete
+	is.True(!cpu.unibus.busy())
+	cpu.unibus.cons.count = 1
+	is.True(cpu.unibus.busy())
+	cpu.unibus.cons.count = 0
+	rk.units[1].seeking = 2
+	is.True(cpu.unibus.busy())
+	rk.units[1].seeking = 1
+	rk.rkcs |= RKCSSCP
+	is.True(!cpu.unibus.busy())
+	rk.units[1].seeking = 0
+	rk.rkcs &^= RKCSSCP
+
+	// so a long seek completes at full speed while the cpu waits
+	cpu.Load(000220, 003000, 0000340) // RK11 vector
+	cpu.Load(003000,
+		0032737, 0020000, 0177404, // BIT #SCP, @#177404
+		0001401, // BEQ .+4
+		0000000, // HALT
+		0000002, // RTI
+	)
+	cpu.Load(002000,
+		0012737, 0014500, 0177412, // MOV #312<<5, @#177412
+		0012737, 0000111, 0177404, // MOV #IDE|SEEK|GO, @#177404
+		0000001, // WAIT
+		0000776, // BR .-2
+	)
+	cpu.R[6] = 001000
+	cpu.R[7] = 002000
+	start := time.Now()
+	cpu.run()
+	is.Equal(cpu.R[7], uint16(003012))
+	is.True(time.Since(start) < time.Second) // sleeping each step takes 2s
+}
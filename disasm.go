@@ -40,6 +40,10 @@ var (
 		{0177700, 0006500, "MFPI", DD, false},
 		{0177700, 0006600, "MTPI", DD, false},
 		{0177700, 0006700, "SXT", DD, false},
+		{0177700, 0106400, "MTPS", DD, false},
+		{0177700, 0106500, "MFPD", DD, false},
+		{0177700, 0106600, "MTPD", DD, false},
+		{0177700, 0106700, "MFPS", DD, false},
 
 		{0177400, 0104000, "EMT", N, false},
 		{0177400, 0104400, "TRAP", N, false},
@@ -90,23 +94,30 @@ var (
 	}
 )
 
+// disasmword returns the word at a in instruction space for disassembly,
+// or zero if it can not be read.
+func (kb *KB11) disasmword(a uint16) uint16 {
+	v, _ := kb.peek(a, ispace)
+	return v
+}
+
 func (kb *KB11) disasmaddr(m, a uint16) {
 	if m&7 > 0 {
 		switch m {
 		case 027:
 			a += 2
-			fmt.Printf("$%06o", kb.read16(a))
+			fmt.Printf("$%06o", kb.disasmword(a))
 			return
 		case 037:
 			a += 2
-			fmt.Printf("*%06o", kb.read16(a))
+			fmt.Printf("*%06o", kb.disasmword(a))
 			return
 		case 067:
 			a += 2
-			fmt.Printf("*%06o", (a+2+(kb.read16(a)))&0xFFFF)
+			fmt.Printf("*%06o", (a+2+(kb.disasmword(a)))&0xFFFF)
 			return
 		case 077:
-			fmt.Printf("**%06o", (a+2+(kb.read16(a)))&0xFFFF)
+			fmt.Printf("**%06o", (a+2+(kb.disasmword(a)))&0xFFFF)
 			return
 		}
 	}
@@ -126,15 +137,15 @@ func (kb *KB11) disasmaddr(m, a uint16) {
 		fmt.Printf("*-(%s)", rs[m&7])
 	case 060:
 		a += 2
-		fmt.Printf("%06o (%s)", kb.read16(a), rs[m&7])
+		fmt.Printf("%06o (%s)", kb.disasmword(a), rs[m&7])
 	case 070:
 		a += 2
-		fmt.Printf("*%06o (%s)", kb.read16(a), rs[m&7])
+		fmt.Printf("*%06o (%s)", kb.disasmword(a), rs[m&7])
 	}
 }
 
 func (kb *KB11) disasm(a uint16) {
-	ins := kb.read16(a)
+	ins := kb.disasmword(a)
 
 	var l D
 	for _, l = range disamtable {
@@ -0,0 +1,257 @@
+package main
+
+import "fmt"
+
+// An op executes the instruction instr, which has already been fetched.
+type op func(kb *KB11, instr uint16)
+
+// optable holds the op for every one of the 65536 instruction words, so
+// step decodes an instruction with a single index rather than a nest of
+// switches.
+var optable [1 << 16]op
+
+// ops lists the instructions in the same form as disamtable. The first
+// entry whose mask and ins match an instruction word executes it, so more
+// specific masks come first. Instruction words which match no entry are
+// reserved instructions.
+var ops = [...]struct {
+	mask, ins uint16
+	fn        op
+}{
+	{0177777, 0000000, func(kb *KB11, instr uint16) { // HALT
+		if kb.currentmode() > 0 {
+			// HALT is illegal outside of kernel mode
+			kb.unibus.cpuerr |= CPUERRHALT
+			kb.trap(INTBUS)
+			return
+		}
+		kb.halted = true
+	}},
+	{0177777, 0000001, func(kb *KB11, instr uint16) { kb.WAIT() }},
+	{0177777, 0000002, func(kb *KB11, instr uint16) { // RTI
+		kb.RTT()
+		if kb.psw&PSWT == PSWT {
+			// RTI traps at once if it sets T, RTT only after
+			// the next instruction
+			kb.trace = true
+		}
+	}},
+	{0177777, 0000003, func(kb *KB11, instr uint16) { kb.trapat(014) }}, // BPT
+	{0177777, 0000004, func(kb *KB11, instr uint16) { kb.trapat(020) }}, // IOT
+	{0177777, 0000005, func(kb *KB11, instr uint16) { kb.RESET() }},
+	{0177777, 0000006, func(kb *KB11, instr uint16) { // RTT
+		kb.require(feat40)
+		kb.RTT()
+	}},
+	{0177777, 0000007, func(kb *KB11, instr uint16) { kb.MFPT() }},
+
+	{0177700, 0000100, func(kb *KB11, instr uint16) { kb.JMP(instr) }},
+	{0177770, 0000200, func(kb *KB11, instr uint16) { kb.RTS(instr) }},
+	{0177770, 0000230, func(kb *KB11, instr uint16) { // SPL
+		kb.require(featSPL)
+		if kb.currentmode() > 0 {
+			// SPL is ignored outside of kernel mode
+			return
+		}
+		kb.writePSW((kb.psw & 0xf81f) | ((instr & 7) << 5))
+	}},
+	{0177760, 0000240, func(kb *KB11, instr uint16) { kb.writePSW(kb.psw &^ (instr & 017)) }}, // CLR CC
+	{0177760, 0000260, func(kb *KB11, instr uint16) { kb.writePSW(kb.psw | (instr & 017)) }},  // SET CC
+	{0177700, 0000300, func(kb *KB11, instr uint16) { kb.SWAB(instr) }},
+
+	{0177700, 0006400, func(kb *KB11, instr uint16) {
+		kb.require(feat40)
+		kb.MARK(instr)
+	}},
+	{0177700, 0006500, func(kb *KB11, instr uint16) {
+		kb.require(featMXPI)
+		kb.MFPI(instr)
+	}},
+	{0177700, 0006600, func(kb *KB11, instr uint16) {
+		kb.require(featMXPI)
+		kb.MTPI(instr)
+	}},
+	{0177700, 0006700, func(kb *KB11, instr uint16) {
+		kb.require(feat40)
+		kb.SXT(instr)
+	}},
+	{0177700, 0106400, func(kb *KB11, instr uint16) {
+		kb.require(featMXPS)
+		kb.MTPS(instr)
+	}},
+	{0177700, 0106500, func(kb *KB11, instr uint16) { // MFPD
+		kb.require(featMXPD)
+		kb.MFPI(instr)
+	}},
+	{0177700, 0106600, func(kb *KB11, instr uint16) { // MTPD
+		kb.require(featMXPD)
+		kb.MTPI(instr)
+	}},
+	{0177700, 0106700, func(kb *KB11, instr uint16) {
+		kb.require(featMXPS)
+		kb.MFPS(instr)
+	}},
+
+	{0177400, 0104000, func(kb *KB11, instr uint16) { kb.trapat(030) }}, // EMT
+	{0177400, 0104400, func(kb *KB11, instr uint16) { kb.trapat(034) }}, // TRAP
+	{0177400, 0100000, func(kb *KB11, instr uint16) { // BPL
+		if !kb.n() {
+			kb.branch(instr)
+		}
+	}},
+	{0177400, 0100400, func(kb *KB11, instr uint16) { // BMI
+		if kb.n() {
+			kb.branch(instr)
+		}
+	}},
+	{0177400, 0101000, func(kb *KB11, instr uint16) { // BHI
+		if !kb.c() && !kb.z() {
+			kb.branch(instr)
+		}
+	}},
+	{0177400, 0101400, func(kb *KB11, instr uint16) { // BLOS
+		if kb.c() || kb.z() {
+			kb.branch(instr)
+		}
+	}},
+	{0177400, 0102000, func(kb *KB11, instr uint16) { // BVC
+		if !kb.v() {
+			kb.branch(instr)
+		}
+	}},
+	{0177400, 0102400, func(kb *KB11, instr uint16) { // BVS
+		if kb.v() {
+			kb.branch(instr)
+		}
+	}},
+	{0177400, 0103000, func(kb *KB11, instr uint16) { // BCC
+		if !kb.c() {
+			kb.branch(instr)
+		}
+	}},
+	{0177400, 0103400, func(kb *KB11, instr uint16) { // BCS
+		if kb.c() {
+			kb.branch(instr)
+		}
+	}},
+	{0177400, 0000400, func(kb *KB11, instr uint16) { kb.branch(instr) }}, // BR
+	{0177400, 0001000, func(kb *KB11, instr uint16) { // BNE
+		if !kb.z() {
+			kb.branch(instr)
+		}
+	}},
+	{0177400, 0001400, func(kb *KB11, instr uint16) { // BEQ
+		if kb.z() {
+			kb.branch(instr)
+		}
+	}},
+	{0177400, 0002000, func(kb *KB11, instr uint16) { // BGE
+		if kb.n() == kb.v() {
+			kb.branch(instr)
+		}
+	}},
+	{0177400, 0002400, func(kb *KB11, instr uint16) { // BLT
+		if kb.n() != kb.v() {
+			kb.branch(instr)
+		}
+	}},
+	{0177400, 0003000, func(kb *KB11, instr uint16) { // BGT
+		if kb.n() == kb.v() && !kb.z() {
+			kb.branch(instr)
+		}
+	}},
+	{0177400, 0003400, func(kb *KB11, instr uint16) { // BLE
+		if kb.n() != kb.v() || kb.z() {
+			kb.branch(instr)
+		}
+	}},
+
+	{0177000, 0004000, func(kb *KB11, instr uint16) { kb.JSR(instr) }},
+	{0177000, 0070000, func(kb *KB11, instr uint16) {
+		kb.require(featEIS)
+		kb.MUL(instr)
+	}},
+	{0177000, 0071000, func(kb *KB11, instr uint16) {
+		kb.require(featEIS)
+		kb.DIV(instr)
+	}},
+	{0177000, 0072000, func(kb *KB11, instr uint16) {
+		kb.require(featEIS)
+		kb.ASH(instr)
+	}},
+	{0177000, 0073000, func(kb *KB11, instr uint16) {
+		kb.require(featEIS)
+		kb.ASHC(instr)
+	}},
+	{0177000, 0074000, func(kb *KB11, instr uint16) {
+		kb.require(feat40)
+		kb.XOR(instr)
+	}},
+	{0177000, 0077000, func(kb *KB11, instr uint16) {
+		kb.require(feat40)
+		kb.SOB(instr)
+	}},
+	{0170000, 0060000, func(kb *KB11, instr uint16) { kb.ADD(instr) }},
+	{0170000, 0160000, func(kb *KB11, instr uint16) { kb.SUB(instr) }},
+
+	{0177700, 0005000, func(kb *KB11, instr uint16) { kb.CLR(2, instr) }},
+	{0177700, 0005100, func(kb *KB11, instr uint16) { kb.COM(2, instr) }},
+	{0177700, 0005200, func(kb *KB11, instr uint16) { kb.INC(2, instr) }},
+	{0177700, 0005300, func(kb *KB11, instr uint16) { kb.DEC(2, instr) }},
+	{0177700, 0005400, func(kb *KB11, instr uint16) { kb.NEG(2, instr) }},
+	{0177700, 0005500, func(kb *KB11, instr uint16) { kb.ADC(2, instr) }},
+	{0177700, 0005600, func(kb *KB11, instr uint16) { kb.SBC(2, instr) }},
+	{0177700, 0005700, func(kb *KB11, instr uint16) { kb.TST(2, instr) }},
+	{0177700, 0006000, func(kb *KB11, instr uint16) { kb.ROR(2, instr) }},
+	{0177700, 0006100, func(kb *KB11, instr uint16) { kb.ROL(2, instr) }},
+	{0177700, 0006200, func(kb *KB11, instr uint16) { kb.ASR(2, instr) }},
+	{0177700, 0006300, func(kb *KB11, instr uint16) { kb.ASL(2, instr) }},
+	{0177700, 0105000, func(kb *KB11, instr uint16) { kb.CLR(1, instr) }},
+	{0177700, 0105100, func(kb *KB11, instr uint16) { kb.COM(1, instr) }},
+	{0177700, 0105200, func(kb *KB11, instr uint16) { kb.INC(1, instr) }},
+	{0177700, 0105300, func(kb *KB11, instr uint16) { kb.DEC(1, instr) }},
+	{0177700, 0105400, func(kb *KB11, instr uint16) { kb.NEG(1, instr) }},
+	{0177700, 0105500, func(kb *KB11, instr uint16) { kb.ADC(1, instr) }},
+	{0177700, 0105600, func(kb *KB11, instr uint16) { kb.SBC(1, instr) }},
+	{0177700, 0105700, func(kb *KB11, instr uint16) { kb.TST(1, instr) }},
+	{0177700, 0106000, func(kb *KB11, instr uint16) { kb.ROR(1, instr) }},
+	{0177700, 0106100, func(kb *KB11, instr uint16) { kb.ROL(1, instr) }},
+	{0177700, 0106200, func(kb *KB11, instr uint16) { kb.ASR(1, instr) }},
+	{0177700, 0106300, func(kb *KB11, instr uint16) { kb.ASL(1, instr) }},
+
+	{0170000, 0010000, func(kb *KB11, instr uint16) { kb.MOV(2, instr) }},
+	{0170000, 0020000, func(kb *KB11, instr uint16) { kb.CMP(2, instr) }},
+	{0170000, 0030000, func(kb *KB11, instr uint16) { kb.BIT(2, instr) }},
+	{0170000, 0040000, func(kb *KB11, instr uint16) { kb.BIC(2, instr) }},
+	{0170000, 0050000, func(kb *KB11, instr uint16) { kb.BIS(2, instr) }},
+	{0170000, 0110000, func(kb *KB11, instr uint16) { kb.MOV(1, instr) }},
+	{0170000, 0120000, func(kb *KB11, instr uint16) { kb.CMP(1, instr) }},
+	{0170000, 0130000, func(kb *KB11, instr uint16) { kb.BIT(1, instr) }},
+	{0170000, 0140000, func(kb *KB11, instr uint16) { kb.BIC(1, instr) }},
+	{0170000, 0150000, func(kb *KB11, instr uint16) { kb.BIS(1, instr) }},
+
+	{0170000, 0170000, func(kb *KB11, instr uint16) {
+		kb.require(featFPP)
+		kb.FPP(instr)
+	}},
+}
+
+func init() {
+	for instr := range optable {
+		optable[instr] = reserved
+		for _, o := range ops {
+			if uint16(instr)&o.mask == o.ins {
+				optable[instr] = o.fn
+				break
+			}
+		}
+	}
+}
+
+// reserved traps to 10 on a reserved instruction.
+func reserved(kb *KB11, instr uint16) {
+	if kb.print {
+		fmt.Printf("unknown instruction %06o\n", instr)
+	}
+	kb.trap(INTINVAL)
+}
@@ -0,0 +1,599 @@
+package main
+
+import "math/bits"
+
+// FP11 floating point status register bits.
+const (
+	FPSER  = 1 << 15 // floating point error
+	FPSID  = 1 << 14 // interrupt disable
+	FPSIUV = 1 << 11 // interrupt on undefined variable
+	FPSIU  = 1 << 10 // interrupt on underflow
+	FPSIV  = 1 << 9  // interrupt on overflow
+	FPSIC  = 1 << 8  // interrupt on integer conversion error
+	FPSD   = 1 << 7  // double precision mode
+	FPSL   = 1 << 6  // long integer mode
+	FPST   = 1 << 5  // truncate mode
+
+	fpsmask = 0147777 // bits 12 and 13 are unused
+)
+
+// FP11 floating exception codes, as reported in FEC.
+const (
+	FECOP    = 2  // op code error
+	FECDIV   = 4  // floating divide by zero
+	FECICVT  = 6  // floating or double to integer conversion error
+	FECOVF   = 8  // floating overflow
+	FECUNF   = 10 // floating underflow
+	FECUNDEF = 12 // floating undefined variable
+)
+
+// FP11 is the 11/45 and 11/70 floating point processor.
+type FP11 struct {
+	ac       [6]uint64 // AC0-AC5, held in D format
+	fps      uint16    // floating point status
+	fec, fea uint16    // floating exception code and address
+}
+
+func (fp *FP11) double() bool { return fp.fps&FPSD == FPSD }
+func (fp *FP11) long() bool   { return fp.fps&FPSL == FPSL }
+
+// get returns accumulator r in the current precision.
+func (fp *FP11) get(r uint16) uint64 {
+	v := fp.ac[r]
+	if !fp.double() {
+		v &^= 0xffffffff
+	}
+	return v
+}
+
+// enabled reports whether the exception code exc will interrupt.
+func (fp *FP11) enabled(exc uint16) bool {
+	switch exc {
+	case FECOVF:
+		return fp.fps&FPSIV == FPSIV
+	case FECUNF:
+		return fp.fps&FPSIU == FPSIU
+	case FECICVT:
+		return fp.fps&FPSIC == FPSIC
+	case FECUNDEF:
+		return fp.fps&FPSIUV == FPSIUV
+	default:
+		return true
+	}
+}
+
+// fpnum is an unpacked PDP11 floating point number. The value is
+// f / 2^63 * 2^(e-128), so a normalised fraction has its hidden bit at bit 62.
+type fpnum struct {
+	s bool   // sign
+	e int    // excess 128 exponent
+	f uint64 // fraction, zero for a zero value
+}
+
+// unpack unpacks a D format value. F format values occupy the upper 32 bits.
+func unpack(v uint64) fpnum {
+	e := int(v>>55) & 0377
+	if e == 0 {
+		return fpnum{}
+	}
+	return fpnum{
+		s: v>>63 == 1,
+		e: e,
+		f: (v&(1<<55-1) | 1<<55) << 7,
+	}
+}
+
+// round normalises x and rounds, or truncates, it to F or D precision.
+// It returns the packed value and FECOVF or FECUNF if the exponent is out of
+// range, in which case the packed exponent has wrapped.
+func (x fpnum) round(double, truncate bool) (uint64, uint16) {
+	if x.f == 0 {
+		return 0, 0
+	}
+	x = x.norm()
+	lsb := uint(39)
+	if double {
+		lsb = 7
+	}
+	if !truncate {
+		x.f += 1 << (lsb - 1)
+		if x.f&(1<<63) != 0 {
+			x.f >>= 1
+			x.e++
+		}
+	}
+	x.f &^= 1<<lsb - 1
+	var exc uint16
+	switch {
+	case x.e > 0377:
+		exc = FECOVF
+	case x.e <= 0:
+		exc = FECUNF
+	}
+	v := uint64(x.e&0377)<<55 | (x.f>>7)&(1<<55-1)
+	if x.s {
+		v |= 1 << 63
+	}
+	return v, exc
+}
+
+// norm normalises x, which must not be zero, so its hidden bit is at bit 62.
+func (x fpnum) norm() fpnum {
+	switch n := bits.LeadingZeros64(x.f) - 1; {
+	case n > 0:
+		x.f <<= uint(n)
+		x.e -= n
+	case n < 0:
+		x.f = x.f>>1 | x.f&1
+		x.e++
+	}
+	return x
+}
+
+func fpadd(a, b fpnum) fpnum {
+	if a.f == 0 {
+		return b
+	}
+	if b.f == 0 {
+		return a
+	}
+	if a.e < b.e {
+		a, b = b, a
+	}
+	d := uint(a.e - b.e)
+	if d > 63 {
+		return a
+	}
+	bf := b.f >> d
+	if b.f&(1<<d-1) != 0 {
+		bf |= 1 // sticky bit for rounding
+	}
+	switch {
+	case a.s == b.s:
+		a.f += bf
+	case bf > a.f:
+		a.f = bf - a.f
+		a.s = b.s
+	default:
+		a.f -= bf
+	}
+	if a.f == 0 {
+		return fpnum{}
+	}
+	return a
+}
+
+func fpmul(a, b fpnum) fpnum {
+	if a.f == 0 || b.f == 0 {
+		return fpnum{}
+	}
+	hi, lo := bits.Mul64(a.f, b.f)
+	f := hi<<1 | lo>>63
+	if lo<<1 != 0 {
+		f |= 1
+	}
+	return fpnum{s: a.s != b.s, e: a.e + b.e - 128, f: f}
+}
+
+// fpdiv returns a / b; b must not be zero.
+func fpdiv(a, b fpnum) fpnum {
+	if a.f == 0 {
+		return fpnum{}
+	}
+	q, r := bits.Div64(a.f>>1, a.f<<63, b.f)
+	if r != 0 {
+		q |= 1
+	}
+	return fpnum{s: a.s != b.s, e: a.e - b.e + 128, f: q}
+}
+
+// fpcmp compares the packed values a and b, returning -1, 0 or +1.
+func fpcmp(a, b uint64) int {
+	if (a>>55)&0377 == 0 {
+		a = 0
+	}
+	if (b>>55)&0377 == 0 {
+		b = 0
+	}
+	switch {
+	case a == b:
+		return 0
+	case a>>63 != b>>63:
+		if a>>63 == 1 {
+			return -1
+		}
+		return 1
+	case (a&^(1<<63) < b&^(1<<63)) == (a>>63 == 0):
+		return -1
+	default:
+		return 1
+	}
+}
+
+// FPP executes the 17xxxx floating point instruction instr.
+func (kb *KB11) FPP(instr uint16) {
+	fp := &kb.fp
+	ac := (instr >> 6) & 3
+	switch (instr >> 8) & 017 {
+	case 0: // 1700xx
+		switch ac {
+		case 0:
+			switch instr & 077 {
+			case 0: // CFCC 170000
+				kb.psw = kb.psw&^017 | fp.fps&017
+			case 1: // SETF 170001
+				fp.fps &^= FPSD
+			case 2: // SETI 170002
+				fp.fps &^= FPSL
+			case 011: // SETD 170011
+				fp.fps |= FPSD
+			case 012: // SETL 170012
+				fp.fps |= FPSL
+			default:
+				kb.fptrap(FECOP)
+			}
+		case 1: // LDFPS 1701SS
+			fp.fps = kb.read(2, kb.fpDA(instr, 2)) & fpsmask
+		case 2: // STFPS 1702DD
+			kb.write(2, kb.fpDA(instr, 2), fp.fps)
+		case 3: // STST 1703DD
+			da := kb.fpDA(instr, 4)
+			kb.write(2, da, fp.fec)
+			if da.a&0177770 != 0170000 {
+				kb.write16(da.a+2, fp.fea)
+			}
+		}
+	case 1: // 1704xx single operand group
+		da := kb.fpDA(instr, fp.size())
+		switch ac {
+		case 0: // CLRF 1704FDST
+			kb.fpwrite(da, fp.double(), 0)
+			kb.fpcc(0, false)
+		case 1: // TSTF 1705FDST
+			kb.fpcc(kb.fpread(da, fp.double()), false)
+		case 2, 3: // ABSF 1706FDST, NEGF 1707FDST
+			v := kb.fpread(da, fp.double())
+			switch {
+			case (v>>55)&0377 == 0:
+				v = 0
+			case ac == 2:
+				v &^= 1 << 63
+			default:
+				v ^= 1 << 63
+			}
+			kb.fpwrite(da, fp.double(), v)
+			kb.fpcc(v, false)
+		}
+	case 2: // MULF 171(AC)FSRC
+		src := unpack(kb.fpsrc(instr, fp.double()))
+		kb.fpresult(ac, fpmul(unpack(fp.get(ac)), src))
+	case 3: // MODF 171(AC+4)FSRC
+		kb.MODF(instr, ac)
+	case 4: // ADDF 172(AC)FSRC
+		src := unpack(kb.fpsrc(instr, fp.double()))
+		kb.fpresult(ac, fpadd(unpack(fp.get(ac)), src))
+	case 5: // LDF 172(AC+4)FSRC
+		v := kb.fpsrc(instr, fp.double())
+		fp.ac[ac] = v
+		kb.fpcc(v, false)
+	case 6: // SUBF 173(AC)FSRC
+		src := unpack(kb.fpsrc(instr, fp.double()))
+		src.s = !src.s
+		kb.fpresult(ac, fpadd(unpack(fp.get(ac)), src))
+	case 7: // CMPF 173(AC+4)FSRC
+		src := kb.fpsrc(instr, fp.double())
+		fp.fps &^= 017
+		switch fpcmp(src, fp.get(ac)) {
+		case -1:
+			fp.fps |= FLAGN
+		case 0:
+			fp.fps |= FLAGZ
+		}
+	case 010: // STF 174(AC)FDST
+		kb.fpwrite(kb.fpDA(instr, fp.size()), fp.double(), fp.get(ac))
+	case 011: // DIVF 174(AC+4)FSRC
+		src := unpack(kb.fpsrc(instr, fp.double()))
+		if src.f == 0 {
+			kb.fptrap(FECDIV)
+			return
+		}
+		kb.fpresult(ac, fpdiv(unpack(fp.get(ac)), src))
+	case 012: // STEXP 175(AC)DST
+		exp := uint16((fp.ac[ac]>>55)&0377) - 128
+		kb.write(2, kb.fpDA(instr, 2), exp)
+		fp.fps &^= 017
+		if exp&0x8000 > 0 {
+			fp.fps |= FLAGN
+		}
+		if exp == 0 {
+			fp.fps |= FLAGZ
+		}
+		kb.psw = kb.psw&^017 | fp.fps&017
+	case 013: // STCFI 175(AC+4)DST
+		kb.STCFI(instr, ac)
+	case 014: // STCFD 176(AC)FDST
+		v := fp.get(ac)
+		var exc uint16
+		if fp.double() {
+			// STCDF rounds to single precision
+			v, exc = kb.fpround(unpack(v), false)
+		}
+		kb.fpwrite(kb.fpDA(instr, 12-fp.size()), !fp.double(), v)
+		kb.fpcc(v, exc == FECOVF)
+		kb.fpexc(exc)
+	case 015: // LDEXP 176(AC+4)SRC
+		exp := int(int16(kb.read(2, kb.fpDA(instr, 2)))) + 128
+		var exc uint16
+		switch {
+		case exp > 0377:
+			exc = FECOVF
+		case exp <= 0:
+			exc = FECUNF
+		}
+		v := fp.ac[ac]&^(0377<<55) | uint64(exp&0377)<<55
+		if exc != 0 && !fp.enabled(exc) {
+			v = 0
+		}
+		fp.ac[ac] = v
+		kb.fpcc(v, exc == FECOVF)
+		kb.fpexc(exc)
+	case 016: // LDCIF 177(AC)SRC
+		kb.LDCIF(instr, ac)
+	case 017: // LDCDF 177(AC+4)FSRC
+		// the source is in the other precision
+		v, exc := kb.fpround(unpack(kb.fpsrc(instr, !fp.double())), fp.double())
+		fp.ac[ac] = v
+		kb.fpcc(v, exc == FECOVF)
+		kb.fpexc(exc)
+	}
+}
+
+// MODF 171(AC+4)FSRC
+func (kb *KB11) MODF(instr, ac uint16) {
+	fp := &kb.fp
+	src := unpack(kb.fpsrc(instr, fp.double()))
+	x := fpmul(unpack(fp.get(ac)), src)
+	v, exc := kb.fpround(x, fp.double())
+	if exc != 0 {
+		fp.ac[ac] = v
+		kb.fpcc(v, exc == FECOVF)
+		kb.fpexc(exc)
+		return
+	}
+	prec := 24
+	if fp.double() {
+		prec = 56
+	}
+	// the full precision product is split, so the fraction keeps the bits
+	// below the precision of the product, and the parts rounded after
+	var integer, fraction fpnum
+	if x.f != 0 {
+		x = x.norm()
+	}
+	switch n := x.e - 128; {
+	case x.f == 0 || n <= 0:
+		fraction = x
+	case n >= prec:
+		integer = unpack(v)
+	default:
+		integer, fraction = x, x
+		integer.f &^= 1<<uint(63-n) - 1
+		fraction.f &= 1<<uint(63-n) - 1
+	}
+	if ac&1 == 0 {
+		fp.ac[ac|1], _ = integer.round(fp.double(), true)
+	}
+	fp.ac[ac], _ = fraction.round(fp.double(), fp.fps&FPST == FPST)
+	kb.fpcc(fp.ac[ac], false)
+}
+
+// STCFI 175(AC+4)DST
+func (kb *KB11) STCFI(instr, ac uint16) {
+	fp := &kb.fp
+	l, lim := uint16(2), int64(1)<<15
+	if fp.long() {
+		l, lim = 4, 1<<31
+	}
+	x := unpack(fp.get(ac))
+	var i int64
+	ok := true
+	if n := x.e - 128; x.f != 0 && n > 0 {
+		if n > 32 {
+			ok = false
+		} else {
+			i = int64(x.f >> uint(63-n))
+			if x.s {
+				i = -i
+			}
+			ok = i >= -lim && i < lim
+		}
+	}
+	if !ok {
+		i = 0
+	}
+	da := kb.fpDA(instr, l)
+	switch {
+	case l == 2:
+		kb.write(2, da, uint16(i))
+	case da.a&0177770 == 0170000, !da.d:
+		kb.write(2, da, uint16(i>>16))
+	default:
+		kb.write16(da.a, uint16(i>>16))
+		kb.write16(da.a+2, uint16(i))
+	}
+	fp.fps &^= 017
+	if i < 0 {
+		fp.fps |= FLAGN
+	}
+	if i == 0 {
+		fp.fps |= FLAGZ
+	}
+	if !ok {
+		fp.fps |= FLAGC
+	}
+	kb.psw = kb.psw&^017 | fp.fps&017
+	if !ok {
+		kb.fpexc(FECICVT)
+	}
+}
+
+// LDCIF 177(AC)SRC
+func (kb *KB11) LDCIF(instr, ac uint16) {
+	fp := &kb.fp
+	var i int32
+	if fp.long() {
+		da := kb.fpDA(instr, 4)
+		switch {
+		case da.a&0177770 == 0170000, !da.d:
+			i = int32(kb.read(2, da)) << 16
+		default:
+			i = int32(kb.read16(da.a))<<16 | int32(kb.read16(da.a+2))
+		}
+	} else {
+		i = int32(int16(kb.read(2, kb.fpDA(instr, 2))))
+	}
+	x := fpnum{e: 128 + 32}
+	if i < 0 {
+		x.s = true
+		i = -i
+	}
+	x.f = uint64(uint32(i)) << 31
+	kb.fpresult(ac, x)
+}
+
+// size returns the length in bytes of a floating operand in the current mode.
+func (fp *FP11) size() uint16 {
+	if fp.double() {
+		return 8
+	}
+	return 4
+}
+
+// fpresult rounds x to the current precision, stores it in ac and sets the
+// floating condition codes, trapping if the result overflowed or underflowed.
+func (kb *KB11) fpresult(ac uint16, x fpnum) {
+	v, exc := kb.fpround(x, kb.fp.double())
+	kb.fp.ac[ac] = v
+	kb.fpcc(v, exc == FECOVF)
+	kb.fpexc(exc)
+}
+
+// fpround rounds x to F or D precision. If the result is out of range and
+// the exception is not enabled the result is zero.
+func (kb *KB11) fpround(x fpnum, double bool) (uint64, uint16) {
+	v, exc := x.round(double, kb.fp.fps&FPST == FPST)
+	if exc != 0 && !kb.fp.enabled(exc) {
+		v = 0
+	}
+	return v, exc
+}
+
+// fpexc raises the floating point trap for exc, if any, and it is enabled.
+func (kb *KB11) fpexc(exc uint16) {
+	if exc != 0 && kb.fp.enabled(exc) {
+		kb.fptrap(exc)
+	}
+}
+
+// fpcc sets the floating condition codes for the value v.
+func (kb *KB11) fpcc(v uint64, overflow bool) {
+	kb.fp.fps &^= 017
+	if v>>63 == 1 {
+		kb.fp.fps |= FLAGN
+	}
+	if (v>>55)&0377 == 0 {
+		kb.fp.fps |= FLAGZ
+	}
+	if overflow {
+		kb.fp.fps |= FLAGV
+	}
+}
+
+// fptrap records the floating exception code and traps to vector 244,
+// unless floating point interrupts are disabled.
+func (kb *KB11) fptrap(code uint16) {
+	kb.fp.fec = code
+	kb.fp.fea = kb.pc
+	kb.fp.fps |= FPSER
+	if kb.fp.fps&FPSID == 0 {
+		kb.trap(INTFPP)
+	}
+}
+
+// fpDA returns the address of a floating point instruction operand l bytes
+// long. Mode 0 operands are returned in the same form as DA.
+func (kb *KB11) fpDA(instr, l uint16) operand {
+	v := instr & 077
+	if v&7 == 7 || v&010 > 0 {
+		l = 2
+	}
+	return kb.ea(v, l)
+}
+
+// fpsrc returns the floating source operand of instr.
+func (kb *KB11) fpsrc(instr uint16, double bool) uint64 {
+	l := uint16(4)
+	if double {
+		l = 8
+	}
+	return kb.fpread(kb.fpDA(instr, l), double)
+}
+
+// fpread reads a floating operand from da, an accumulator or memory.
+func (kb *KB11) fpread(da operand, double bool) uint64 {
+	var v uint64
+	switch {
+	case da.a&0177770 == 0170000:
+		r := da.a & 7
+		if r > 5 {
+			kb.fptrap(FECOP)
+			return 0
+		}
+		v = kb.fp.ac[r]
+	case !da.d:
+		// immediate operands are a single word
+		v = uint64(kb.read(2, da)) << 48
+	default:
+		n := uint16(2)
+		if double {
+			n = 4
+		}
+		for i := uint16(0); i < n; i++ {
+			v |= uint64(kb.read16(da.a+2*i)) << (48 - 16*i)
+		}
+	}
+	if !double {
+		v &^= 0xffffffff
+	}
+	if v>>55 == 0400 && kb.fp.fps&FPSIUV == FPSIUV {
+		// minus zero is the undefined variable
+		kb.fptrap(FECUNDEF)
+	}
+	return v
+}
+
+// fpwrite writes the floating operand v to da, an accumulator or memory.
+func (kb *KB11) fpwrite(da operand, double bool, v uint64) {
+	if !double {
+		v &^= 0xffffffff
+	}
+	switch {
+	case da.a&0177770 == 0170000:
+		r := da.a & 7
+		if r > 5 {
+			kb.fptrap(FECOP)
+			return
+		}
+		kb.fp.ac[r] = v
+	case !da.d:
+		kb.write(2, da, uint16(v>>48))
+	default:
+		n := uint16(2)
+		if double {
+			n = 4
+		}
+		for i := uint16(0); i < n; i++ {
+			kb.write16(da.a+2*i, uint16(v>>(48-16*i)))
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestADDF(t *testing.T) {
+	is := is.New(t)
+	var cpu KB11
+	cpu.Load(002000,
+		0170001,          // SETF
+		0172427, 0040200, // LDF #1.0, AC0
+		0172027, 0040400, // ADDF #2.0, AC0
+		0173027, 0040600, // SUBF #4.0, AC0
+	)
+	cpu.R[7] = 002000
+	cpu.step()
+	cpu.step()
+	cpu.step()
+	is.Equal(cpu.fp.ac[0], uint64(0040500)<<48) // 3.0
+	cpu.step()
+	is.Equal(cpu.fp.ac[0], uint64(0140200)<<48) // -1.0
+	is.Equal(cpu.fp.fps&017, uint16(FLAGN))
+}
+
+func TestMULFDIVF(t *testing.T) {
+	is := is.New(t)
+	var cpu KB11
+	cpu.Load(002000,
+		0172427, 0040500, // LDF #3.0, AC0
+		0171027, 0040700, // MULF #6.0, AC0
+		0174427, 0041000, // DIVF #8.0, AC0
+	)
+	cpu.R[7] = 002000
+	cpu.step()
+	cpu.step()
+	is.Equal(cpu.fp.ac[0], uint64(0041220)<<48) // 18.0
+	cpu.step()
+	is.Equal(cpu.fp.ac[0], uint64(0040420)<<48) // 2.25
+}
+
+func TestDIVFByZero(t *testing.T) {
+	is := is.New(t)
+	var cpu KB11
+	cpu.fp.fps = FPSID
+	cpu.Load(002000,
+		0172427, 0040500, // LDF #3.0, AC0
+		0174427, 0000000, // DIVF #0.0, AC0
+	)
+	cpu.R[7] = 002000
+	cpu.step()
+	cpu.step()
+	is.Equal(cpu.fp.ac[0], uint64(0040500)<<48) // unchanged
+	is.Equal(cpu.fp.fec, uint16(FECDIV))
+	is.Equal(cpu.fp.fea, uint16(002004))
+	is.True(cpu.fp.fps&FPSER > 0)
+}
+
+func TestLDCIFSTCFI(t *testing.T) {
+	is := is.New(t)
+	var cpu KB11
+	cpu.Load(002000,
+		0177100, // LDCIF R0, AC1
+		0175502, // STCFI AC1, R2
+	)
+	for _, i := range []int16{0, 1, -1, 12345, -12345, 32767, -32768} {
+		cpu.R[0] = uint16(i)
+		cpu.R[7] = 002000
+		cpu.step()
+		cpu.step()
+		t.Logf("R0: %06o", uint16(i))
+		is.Equal(cpu.R[2], uint16(i))
+		is.Equal(cpu.n(), i < 0)
+		is.Equal(cpu.z(), i == 0)
+		is.Equal(cpu.c(), false)
+	}
+}
+
+func TestSTCFIOverflow(t *testing.T) {
+	is := is.New(t)
+	var cpu KB11
+	cpu.fp.fps = FPSL
+	cpu.Load(002000,
+		0177001,          // LDCLF R1, AC0
+		0170002,          // SETI
+		0175402,          // STCFI AC0, R2
+		0170012,          // SETL
+		0175437, 0003000, // STCFL AC0, @#3000
+	)
+	cpu.R[1] = 0100000 // -2^31
+	cpu.R[2] = 0177777
+	cpu.R[7] = 002000
+	cpu.step()
+	cpu.step()
+	cpu.step()
+	is.Equal(cpu.R[2], uint16(0))
+	is.Equal(cpu.c(), true)
+	cpu.step()
+	cpu.step()
+	is.Equal(cpu.unibus.core[03000>>1], uint16(0100000))
+	is.Equal(cpu.unibus.core[03002>>1], uint16(0))
+	is.Equal(cpu.c(), false)
+}
+
+func TestMODF(t *testing.T) {
+	is := is.New(t)
+	var cpu KB11
+	cpu.Load(002000,
+		0172427, 0040440, // LDF #2.5, AC0
+		0171427, 0040200, // MODF #1.0, AC0
+	)
+	cpu.R[7] = 002000
+	cpu.step()
+	cpu.step()
+	is.Equal(cpu.fp.ac[1], uint64(0040400)<<48) // 2.0
+	is.Equal(cpu.fp.ac[0], uint64(0040000)<<48) // 0.5
+
+	// the fraction keeps the bits the rounded product loses
+	cpu.Load(002010, 0042600, 0020000, 0040200, 0000001) // 1025.0, 1+2^-23
+	cpu.Load(002000,
+		0172437, 002010, // LDF @#2010, AC0
+		0171437, 002014, // MODF @#2014, AC0
+	)
+	cpu.R[7] = 002000
+	cpu.step()
+	cpu.step()
+	is.Equal(cpu.fp.ac[1], uint64(0042600)<<48|uint64(0020000)<<32) // 1025.0
+	is.Equal(cpu.fp.ac[0], uint64(0035000)<<48|uint64(0020000)<<32) // 2^-13+2^-23
+}
+
+func TestCMPF(t *testing.T) {
+	is := is.New(t)
+	var cpu KB11
+	cpu.Load(002000,
+		0172427, 0040500, // LDF #3.0, AC0
+		0173427, 0040200, // CMPF #1.0, AC0
+		0170000, // CFCC
+	)
+	cpu.R[7] = 002000
+	cpu.step()
+	cpu.step()
+	cpu.step()
+	is.Equal(cpu.n(), true)
+	is.Equal(cpu.z(), false)
+}
+
+func TestSETDLDCLD(t *testing.T) {
+	is := is.New(t)
+	var cpu KB11
+	cpu.Load(002000,
+		0170011,          // SETD
+		0170012,          // SETL
+		0177000,          // LDCLD R0, AC0
+		0172027, 0040200, // ADDD #1.0, AC0
+		0175437, 0003000, // STCDL AC0, @#3000
+	)
+	cpu.unibus.core[03000>>1] = 0077777
+	cpu.unibus.core[03002>>1] = 0177777
+	cpu.R[0] = 0077777
+	cpu.R[7] = 002000
+	for i := 0; i < 5; i++ {
+		cpu.step()
+	}
+	// 2^31 - 2^16 + 1 needs more than 24 bits of precision
+	is.Equal(cpu.unibus.core[03000>>1], uint16(0077777))
+	is.Equal(cpu.unibus.core[03002>>1], uint16(1))
+}
@@ -1,117 +1,341 @@
 package main
 
-import (
-	"fmt"
-)
-
 type page struct {
 	par, pdr uint16
 }
 
-func (p *page) addr() addr18 { return addr18(p.par & 07777) }
+func (p *page) addr() addr22 { return addr22(p.par) }
 func (p *page) len() uint16  { return (p.pdr >> 8) & 0x7f }
-func (p *page) read() bool   { return p.pdr&2 == 2 }
-func (p *page) write() bool  { return p.pdr&6 == 6 }
+func (p *page) acf() uint16  { return p.pdr & 7 }
 func (p *page) ed() bool     { return p.pdr&8 == 8 }
 
+// PDR access control field values.
+const (
+	ACFNR   = 0 // non-resident, abort all accesses
+	ACFROT  = 1 // read only, trap on read
+	ACFRO   = 2 // read only
+	ACFRWT  = 4 // read/write, trap on read or write
+	ACFRWTW = 5 // read/write, trap on write
+	ACFRW   = 6 // read/write
+)
+
+// PDR bits.
+const (
+	PDRW     = 1 << 6 // written
+	PDRA     = 1 << 7 // accessed, an access met the trap condition
+	pdrwmask = 077417 // the PDR bits software can write
+)
+
+// resident reports whether the page can be accessed at all.
+func (p *page) resident() bool {
+	switch p.acf() {
+	case ACFROT, ACFRO, ACFRWT, ACFRWTW, ACFRW:
+		return true
+	default:
+		return false
+	}
+}
+
+// readonly reports whether writes to the page abort.
+func (p *page) readonly() bool { return p.acf() == ACFROT || p.acf() == ACFRO }
+
+// traps reports whether an access to the page meets its trap condition.
+func (p *page) traps(wr bool) bool {
+	switch p.acf() {
+	case ACFROT, ACFRWT:
+		return true
+	case ACFRWTW:
+		return wr
+	default:
+		return false
+	}
+}
+
+// beyond reports whether block is outside the page length, which grows up
+// from block 0 or, if the page expands downwards, down from block 127.
+func (p *page) beyond(block uint16) bool {
+	if p.ed() {
+		return block < p.len()
+	}
+	return block > p.len()
+}
+
+// Address spaces for KT11.decode.
+const (
+	ispace = false // instruction space
+	dspace = true  // data space
+)
+
+// KT11 memory management, SR3 bits.
+const (
+	SR3UDS   = 1 << 0 // user D space enable
+	SR3SDS   = 1 << 1 // supervisor D space enable
+	SR3KDS   = 1 << 2 // kernel D space enable
+	SR3MAP22 = 1 << 4 // 22 bit mapping enable
+	SR3UBMAP = 1 << 5 // Unibus map enable
+)
+
 type KT11 struct {
-	SR0, SR1, SR2 uint16
-	pages         [4][16]page
+	SR0, SR1, SR2, SR3 uint16
+	pages              [4][16]page // pages 0-7 are I space, 8-15 D space
+
+	trap bool // a memory management trap is pending
+
+	// tlb caches translations to memory by write, mode, I or D space
+	// and the top three bits of the virtual address.
+	tlb [2][4][2][8]tlbentry
 }
 
-func (kt *KT11) decode(wr bool, a, mode uint16) addr18 {
-	if kt.SR0&01 == 0 {
-		addr := addr18(a)
-		if addr > 0167777 {
-			return addr + 0600000
-		}
-		//fmt.Printf("decode: fast %06o -> %06o\n", a, addr)
-		return addr
+// A tlbentry caches the translation of the part of a page, the offsets lo
+// to hi, which maps to memory and can be accessed without side effects.
+type tlbentry struct {
+	valid  bool
+	lo, hi uint16 // offsets within the page
+	base   addr22 // the physical address of offset 0
+}
+
+// KT11 memory management, SR0 bits.
+const (
+	SR0ENABLE = 1 << 0  // relocation enabled
+	SR0MAINT  = 1 << 8  // maintenance, only destination references are relocated
+	SR0TRAPEN = 1 << 9  // enable memory management traps
+	SR0TRAP   = 1 << 12 // memory management trap
+	SR0RO     = 1 << 13 // abort, read only
+	SR0PL     = 1 << 14 // abort, page length
+	SR0NR     = 1 << 15 // abort, non-resident
+
+	sr0wmask = 0171577 // the SR0 bits software can write
+)
+
+// frozen reports whether SR0, SR1 and SR2 hold the state of an earlier
+// abort. They do not change until the abort bits in SR0 are cleared.
+func (kt *KT11) frozen() bool { return kt.SR0&(SR0NR|SR0PL|SR0RO) != 0 }
+
+// abort records the reason for an abort, and the page and mode which
+// caused it, in SR0 unless it is frozen. It returns false.
+func (kt *KT11) abort(reason, page, mode uint16) bool {
+	if !kt.frozen() {
+		kt.SR0 = kt.SR0&(SR0ENABLE|SR0MAINT|SR0TRAPEN|SR0TRAP) | reason | mode<<5 | page<<1
+	}
+	return false
+}
+
+// record records in SR1 that register r was changed by delta, so that an
+// aborted instruction can be backed out and restarted. SR1 has room for
+// two changes, any more are ignored.
+func (kt *KT11) record(r uint16, delta int16) {
+	if kt.frozen() || kt.SR1&0177400 != 0 {
+		return
+	}
+	v := (uint16(delta)&037)<<3 | r
+	if kt.SR1 == 0 {
+		kt.SR1 = v
+		return
+	}
+	kt.SR1 |= v << 8
+}
+
+// dspace reports whether separate D space is enabled for mode.
+func (kt *KT11) dspace(mode uint16) bool {
+	switch mode {
+	case 0:
+		return kt.SR3&SR3KDS == SR3KDS
+	case 1:
+		return kt.SR3&SR3SDS == SR3SDS
+	case 3:
+		return kt.SR3&SR3UDS == SR3UDS
+	default:
+		return false
 	}
+}
+
+// relocating reports whether accesses, or writes if wr is set, are
+// relocated through the page registers.
+func (kt *KT11) relocating(wr bool) bool {
+	return kt.SR0&SR0ENABLE == SR0ENABLE && (kt.SR0&SR0MAINT == 0 || wr)
+}
+
+// index returns the index into pages of the page which maps the virtual
+// address a in mode.
+func (kt *KT11) index(a, mode uint16, d bool) uint16 {
 	i := a >> 13
-	if wr && !kt.pages[mode][i].write() {
-		kt.SR0 = (1 << 13) | 1
-		kt.SR0 |= a >> 12 & ^uint16(1)
-		if mode > 0 {
-			kt.SR0 |= (1 << 5) | (1 << 6)
-		}
-		// SR2 = cpu.PC;
-		fmt.Printf("mmu::decode write to read-only page %06o\n", a)
-		panic(trap{INTFAULT})
-	}
-	if !kt.pages[mode][i].read() {
-		kt.SR0 = (1 << 15) | 1
-		kt.SR0 |= a >> 12 & ^uint16(1)
-		if mode > 0 {
-			kt.SR0 |= (1 << 5) | (1 << 6)
+	if d && kt.dspace(mode) {
+		i += 8
+	}
+	return i
+}
+
+// translate translates the virtual address a in mode to a physical address
+// without side effects. If d is set and D space is enabled for the mode, a
+// is mapped through the D space registers, otherwise through the I space
+// registers. If the access is not allowed translate returns the SR0 abort
+// bits which say why, otherwise zero.
+// In 18 bit mode the relocated address is truncated to 18 bits and the
+// 18 bit I/O page is moved to the top of the 22 bit address space.
+func (kt *KT11) translate(wr bool, a, mode uint16, d bool) (addr22, uint16) {
+	if !kt.relocating(wr) {
+		addr := addr22(a)
+		if addr > 0167777 {
+			return addr + (iopage - 0160000), 0
 		}
-		// SR2 = cpu.PC;
-		fmt.Printf("mmu::decode read from no-access page %06o\n", a)
-		panic(trap{INTFAULT})
+		return addr, 0
 	}
+	p := &kt.pages[mode][kt.index(a, mode, d)]
 	block := (a >> 6) & 0177
-	disp := addr18(a & 077)
-	if (kt.pages[mode][i].ed() && (block < kt.pages[mode][i].len())) || (!kt.pages[mode][i].ed() && (block > kt.pages[mode][i].len())) {
-		kt.SR0 = (1 << 14) | 1
-		kt.SR0 |= a >> 12 & ^uint16(1)
-		if mode > 0 {
-			kt.SR0 |= (1 << 5) | (1 << 6)
+	disp := addr22(a & 077)
+	var reason uint16
+	if !p.resident() {
+		reason |= SR0NR
+	}
+	if p.beyond(block) {
+		reason |= SR0PL
+	}
+	if wr && p.readonly() {
+		reason |= SR0RO
+	}
+	if reason != 0 {
+		return 0, reason
+	}
+	aa := ((p.addr() + addr22(block)) << 6) + disp
+	if kt.SR3&SR3MAP22 == SR3MAP22 {
+		return aa & 017777777, 0
+	}
+	aa &= 0777777
+	if aa >= 0760000 {
+		aa += iopage - 0760000
+	}
+	return aa, 0
+}
+
+// decode translates the virtual address a in mode to a physical address for
+// an access by the cpu.
+// If the access is not allowed SR0 records why and decode returns false.
+// An access which meets the page's trap condition completes and, if traps
+// are enabled, leaves a memory management trap pending.
+func (kt *KT11) decode(wr bool, a, mode uint16, d bool) (addr22, bool) {
+	aa, reason := kt.translate(wr, a, mode, d)
+	if !kt.relocating(wr) {
+		return aa, true
+	}
+	i := kt.index(a, mode, d)
+	p := &kt.pages[mode][i]
+	if reason != 0 {
+		return 0, kt.abort(reason, i, mode)
+	}
+	if p.traps(wr) {
+		p.pdr |= PDRA
+		if kt.SR0&SR0TRAPEN == SR0TRAPEN {
+			if !kt.frozen() {
+				kt.SR0 = kt.SR0&^0176 | mode<<5 | i<<1
+			}
+			kt.SR0 |= SR0TRAP
+			kt.trap = true
 		}
-		// SR2 = cpu.PC;
-		fmt.Printf("page length exceeded, address %06o (block %03o) is beyond length %03o\n",
-			a, block, kt.pages[mode][i].len())
-		panic(trap{INTFAULT})
 	}
 	if wr {
-		kt.pages[mode][i].pdr |= 1 << 6
+		p.pdr |= PDRW
+	}
+	return aa, true
+}
+
+// cached returns the memory address which the virtual address a in mode
+// maps to, if the translation is in the tlb.
+func (kt *KT11) cached(wr bool, a, mode uint16, d bool) (addr22, bool) {
+	e := &kt.tlb[b2i(wr)][mode][b2i(d)][a>>13]
+	off := a & 017777
+	if !e.valid || off < e.lo || off > e.hi || a&1 == 1 {
+		return 0, false
+	}
+	return e.base + addr22(off), true
+}
+
+// cache adds the translation of the page which maps the virtual address a
+// in mode to the tlb after decode has allowed an access to it. Pages which
+// trap, or which do not map entirely to memory below top, are not cached.
+func (kt *KT11) cache(wr bool, a, mode uint16, d bool, top addr22) {
+	e := tlbentry{valid: true, hi: 017777}
+	if kt.relocating(wr) {
+		p := &kt.pages[mode][kt.index(a, mode, d)]
+		if p.traps(wr) {
+			return
+		}
+		if kt.SR3&SR3MAP22 == 0 && top > 0760000 {
+			// the 18 bit I/O page
+			top = 0760000
+		}
+		e.base = p.addr() << 6
+		if p.ed() {
+			e.lo = p.len() << 6
+		} else {
+			e.hi = p.len()<<6 | 077
+		}
+	} else {
+		e.base = addr22(a &^ 017777)
+		if top > 0160000 {
+			// the 16 bit I/O page
+			top = 0160000
+		}
+	}
+	if e.base+addr22(e.hi) >= top {
+		return
 	}
-	aa := ((kt.pages[mode][i].addr() + addr18(block)) << 6) + disp
-	if aa&0777770 == 0777560 {
-		//	fmt.Printf("decode: slow %06o -> %06o\n", a, aa)
+	kt.tlb[b2i(wr)][mode][b2i(d)][a>>13] = e
+}
+
+// flush empties the tlb. It must be called whenever a PAR, PDR, SR0 or SR3
+// changes.
+func (kt *KT11) flush() { kt.tlb = [2][4][2][8]tlbentry{} }
+
+func b2i(b bool) int {
+	if b {
+		return 1
 	}
-	return aa
+	return 0
 }
 
-func (kt *KT11) write16(addr addr18, v uint16) {
+// write16 writes a PAR or PDR. Writing either clears the A and W bits
+// of the page.
+func (kt *KT11) write16(addr addr18, v uint16) bool {
 	// fmt.Printf("kt11:write16: %06o %06o\n", addr, v)
-	i := (addr & 017) >> 1
+	i := (addr & 037) >> 1
+	var p *page
 	switch addr & ^addr18(037) {
-	case 0772200:
-		kt.pages[01][i].pdr = v
-	case 0772240:
-		kt.pages[01][i].par = v
-	case 0772300:
-		kt.pages[00][i].pdr = v
-	case 0772340:
-		kt.pages[00][i].par = v
-	case 0777600:
-		kt.pages[03][i].pdr = v
-	case 0777640:
-		kt.pages[03][i].par = v
+	case 0772200, 0772240:
+		p = &kt.pages[01][i]
+	case 0772300, 0772340:
+		p = &kt.pages[00][i]
+	case 0777600, 0777640:
+		p = &kt.pages[03][i]
 	default:
-		fmt.Printf("mmu:write16: %06o %06o\n", addr, v)
-		panic(trap{INTBUS})
+		return false
+	}
+	if addr&040 == 040 {
+		p.par = v
+		p.pdr &^= PDRA | PDRW
+	} else {
+		p.pdr = v & pdrwmask
 	}
+	kt.flush()
+	return true
 }
 
-func (kt *KT11) read16(addr addr18) uint16 {
+func (kt *KT11) read16(addr addr18) (uint16, bool) {
 	// fmt.Printf("kt11:read16: %06o\n", addr)
-	i := (addr & 017) >> 1
+	i := (addr & 037) >> 1
 	switch addr & ^addr18(037) {
 	case 0772200:
-		return kt.pages[01][i].pdr
+		return kt.pages[01][i].pdr, true
 	case 0772240:
-		return kt.pages[01][i].par
+		return kt.pages[01][i].par, true
 	case 0772300:
-		return kt.pages[00][i].pdr
+		return kt.pages[00][i].pdr, true
 	case 0772340:
-		return kt.pages[00][i].par
+		return kt.pages[00][i].par, true
 	case 0777600:
-		return kt.pages[03][i].pdr
+		return kt.pages[03][i].pdr, true
 	case 0777640:
-		return kt.pages[03][i].par
+		return kt.pages[03][i].par, true
 	default:
-		fmt.Printf("mmu:write16: %06o\n", addr)
-		panic(trap{INTBUS})
+		return 0, false
 	}
 }
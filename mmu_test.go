@@ -0,0 +1,305 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestSplitID(t *testing.T) {
+	is := is.New(t)
+	var cpu KB11
+	cpu.unibus.mmu = &cpu.mmu
+
+	// kernel I page 0 maps to 000000, kernel D page 0 maps to 020000.
+	cpu.Load(017772300, 077406) // KIPDR0
+	cpu.Load(017772320, 077406) // KDPDR0
+	cpu.Load(017772340, 0)      // KIPAR0
+	cpu.Load(017772360, 0200)   // KDPAR0
+	cpu.Load(017772516, 4)      // MMR3, kernel D space enabled
+	cpu.Load(017777572, 1)      // MMR0, enable the mmu
+	cpu.Load(0020100, 0054321)  // D space 000100
+	cpu.Load(0000100, 0012345)  // I space 000100
+	cpu.Load(002000,
+		0012737, 0000001, 0000200, // MOV #1, @#200
+		0013700, 0000100, // MOV @#100, R0
+		0016701, 0200000+0100-02016, // MOV 100, R1
+	)
+	cpu.R[7] = 002000
+	cpu.step()
+	is.Equal(cpu.unibus.core[0020200>>1], uint16(1)) // written to D space
+	is.Equal(cpu.unibus.core[0000200>>1], uint16(0))
+	cpu.step()
+	is.Equal(cpu.R[0], uint16(0054321))
+	cpu.step()
+	is.Equal(cpu.R[1], uint16(0054321))
+
+	// without D space enabled, data comes from I space
+	cpu.Load(017772516, 0)
+	cpu.R[7] = 002006
+	cpu.step()
+	is.Equal(cpu.R[0], uint16(0012345))
+}
+
+func Test22BitMapping(t *testing.T) {
+	is := is.New(t)
+	var cpu KB11
+	cpu.unibus.mmu = &cpu.mmu
+	cpu.unibus.memsize = 02000000 // 512 KB
+
+	cpu.Load(017772300, 077406, 077406) // KIPDR0, KIPDR1
+	cpu.Load(017772340, 0, 012000)      // KIPAR0, KIPAR1 maps to 01200000
+	cpu.Load(017777572, 1)              // MMR0, enable the mmu
+	cpu.Load(002000,
+		0012737, 0000001, 0020000, // MOV #1, @#20000
+	)
+
+	// 18 bit mode truncates the relocated address
+	cpu.R[7] = 002000
+	cpu.step()
+	is.Equal(cpu.unibus.core[0200000>>1], uint16(1))
+
+	cpu.Load(017772516, SR3MAP22)
+	cpu.R[7] = 002000
+	cpu.step()
+	is.Equal(cpu.unibus.core[01200000>>1], uint16(1))
+}
+
+func TestAbort(t *testing.T) {
+	is := is.New(t)
+	var cpu KB11
+	cpu.unibus.mmu = &cpu.mmu
+
+	// kernel page 0 is read/write, page 1 is not resident
+	cpu.Load(017772300, 077406) // KIPDR0
+	cpu.Load(017777572, 1)      // MMR0, enable the mmu
+	cpu.Load(000250, 003000, 0000340)
+	cpu.Load(002000,
+		0013721, 0020000, // MOV @#20000, (R1)+
+	)
+	cpu.Load(001000, 0177777)
+	cpu.R[1] = 001000
+	cpu.R[6] = 001000
+	cpu.R[7] = 002000
+	cpu.psw = FLAGZ
+	cpu.step()
+	is.True(cpu.abort)
+	is.Equal(cpu.saved.vec, uint16(INTFAULT))
+	is.Equal(cpu.mmu.SR0&0160001, uint16(0100001)) // non-resident, page 1
+	is.Equal(cpu.mmu.SR0>>1&7, uint16(1))
+	is.Equal(cpu.mmu.SR1, uint16(0027))   // PC +2 fetching the absolute address
+	is.Equal(cpu.mmu.SR2, uint16(002000)) // the aborted instruction
+
+	cpu.aborttrap()
+	is.Equal(cpu.R[1], uint16(001000)) // the instruction was aborted reading its source
+	is.Equal(cpu.unibus.core[001000>>1], uint16(0177777))
+	is.Equal(cpu.R[7], uint16(003000))
+	is.Equal(cpu.psw, uint16(0000340))
+	is.Equal(cpu.R[6], uint16(000774))
+	is.Equal(cpu.unibus.core[000774>>1], uint16(002004)) // PC
+	is.Equal(cpu.unibus.core[000776>>1], uint16(FLAGZ))  // PSW unchanged by MOV
+}
+
+func TestSR1SR2(t *testing.T) {
+	is := is.New(t)
+	var cpu KB11
+	cpu.unibus.mmu = &cpu.mmu
+
+	// kernel page 0 is read/write, page 1 is read only
+	cpu.Load(017772300, 077406, 077402) // KIPDR0, KIPDR1
+	cpu.Load(017772340, 0, 0200)        // KIPAR0, KIPAR1
+	cpu.Load(017777572, 1)              // MMR0, enable the mmu
+	cpu.Load(002000,
+		0012142, // MOV (R1)+, -(R2)
+		0005721, // TST (R1)+
+	)
+	cpu.R[1] = 001000
+	cpu.R[2] = 020002
+	cpu.R[7] = 002000
+	cpu.step()
+	is.True(cpu.abort)
+	is.Equal(cpu.saved.vec, uint16(INTFAULT))
+	is.Equal(cpu.mmu.SR0, uint16(SR0RO|1<<1|1))
+	is.Equal(cpu.mmu.SR1, uint16(0362<<8|0021)) // R2 -2, R1 +2
+	is.Equal(cpu.mmu.SR2, uint16(002000))
+	cpu.abort = false
+
+	// SR0, SR1 and SR2 are frozen until the abort is cleared
+	cpu.step()
+	is.Equal(cpu.mmu.SR1, uint16(0362<<8|0021))
+	is.Equal(cpu.mmu.SR2, uint16(002000))
+
+	cpu.Load(017777572, 1)
+	cpu.R[7] = 002002
+	cpu.step()
+	is.Equal(cpu.mmu.SR1, uint16(0021))
+	is.Equal(cpu.mmu.SR2, uint16(002002))
+
+	// SR1 records only the first two changes
+	cpu.mmu.SR1 = 0
+	cpu.mmu.record(1, 2)
+	cpu.mmu.record(2, -2)
+	cpu.mmu.record(6, -2)
+	is.Equal(cpu.mmu.SR1, uint16(0362<<8|0021))
+}
+
+func TestAccessControl(t *testing.T) {
+	is := is.New(t)
+	var kt KT11
+
+	access := func(acf uint16, wr bool) (ok, trap bool) {
+		kt.SR0 = SR0ENABLE | SR0TRAPEN
+		kt.trap = false
+		kt.write16(0772300, 077400|acf) // KIPDR0
+		_, ok = kt.decode(wr, 0, 0, ispace)
+		return ok, kt.trap
+	}
+
+	for _, tt := range []struct {
+		acf      uint16
+		wr       bool
+		ok, trap bool
+	}{
+		{ACFNR, false, false, false},
+		{ACFROT, false, true, true},
+		{ACFROT, true, false, false},
+		{ACFRO, false, true, false},
+		{ACFRO, true, false, false},
+		{3, false, false, false},
+		{ACFRWT, false, true, true},
+		{ACFRWT, true, true, true},
+		{ACFRWTW, false, true, false},
+		{ACFRWTW, true, true, true},
+		{ACFRW, true, true, false},
+		{7, false, false, false},
+	} {
+		ok, trap := access(tt.acf, tt.wr)
+		t.Logf("acf: %o, write: %v", tt.acf, tt.wr)
+		is.Equal(ok, tt.ok)
+		is.Equal(trap, tt.trap)
+		is.Equal(kt.pages[0][0].pdr&PDRA == PDRA, tt.trap)
+		is.Equal(kt.SR0&SR0TRAP == SR0TRAP, tt.trap)
+	}
+
+	// without the trap enable the access only sets the A bit
+	kt.write16(0772300, 077400|ACFRWT)
+	kt.SR0 = SR0ENABLE
+	kt.trap = false
+	_, ok := kt.decode(true, 0, 0, ispace)
+	is.True(ok)
+	is.True(!kt.trap)
+	is.Equal(kt.pages[0][0].pdr, uint16(077400|PDRA|PDRW|ACFRWT))
+
+	// writing the PAR clears A and W
+	kt.write16(0772340, 0)
+	is.Equal(kt.pages[0][0].pdr, uint16(077400|ACFRWT))
+
+	// a downward expanding page of 2 blocks
+	kt.write16(0772300, 0176<<8|8|ACFRW)
+	_, ok = kt.decode(false, 017700, 0, ispace)
+	is.True(ok)
+	_, ok = kt.decode(false, 017500, 0, ispace)
+	is.True(!ok)
+	is.Equal(kt.SR0&^SR0ENABLE, uint16(SR0PL))
+
+	// in maintenance mode only destination references are relocated
+	kt.SR0 = SR0ENABLE | SR0MAINT
+	kt.write16(0772300, 077400|ACFRW)
+	kt.write16(0772340, 0100)
+	a, _ := kt.decode(false, 0100, 0, ispace)
+	is.Equal(a, addr22(0100))
+	a, _ = kt.decode(true, 0100, 0, ispace)
+	is.Equal(a, addr22(010100))
+}
+
+func TestTranslate(t *testing.T) {
+	is := is.New(t)
+	var cpu KB11
+	cpu.unibus.mmu = &cpu.mmu
+
+	cpu.Load(017772300, 077404, 077402) // KIPDR0 trap on access, KIPDR1 read only
+	cpu.Load(017772340, 0100, 0200)     // KIPAR0, KIPAR1
+	cpu.Load(017777572, SR0ENABLE|SR0TRAPEN)
+	cpu.Load(010100, 0012345)
+
+	a, reason := cpu.mmu.translate(true, 0100, 0, ispace)
+	is.Equal(a, addr22(010100))
+	is.Equal(reason, uint16(0))
+	_, reason = cpu.mmu.translate(true, 020000, 0, ispace)
+	is.Equal(reason, uint16(SR0RO))
+	_, reason = cpu.mmu.translate(false, 0, 3, ispace)
+	is.Equal(reason, uint16(SR0NR))
+
+	v, ok := cpu.peek(0100, ispace)
+	is.True(ok)
+	is.Equal(v, uint16(0012345))
+	_, ok = cpu.peek(0177776, ispace) // kernel page 7 is not resident
+	is.True(!ok)
+
+	// nothing changed
+	is.Equal(cpu.mmu.SR0, uint16(SR0ENABLE|SR0TRAPEN))
+	is.Equal(cpu.mmu.pages[0][0].pdr, uint16(077404))
+	is.True(!cpu.mmu.trap)
+}
+
+func TestTLB(t *testing.T) {
+	is := is.New(t)
+	var cpu KB11
+	cpu.unibus.mmu = &cpu.mmu
+
+	cpu.Load(017772300, 077406, 077406) // KIPDR0, KIPDR1
+	cpu.Load(017772340, 0, 0100)        // KIPAR0, KIPAR1
+	cpu.Load(017777572, 1)              // MMR0, enable the mmu
+	cpu.Load(010100, 1)
+	cpu.Load(020100, 2)
+	cpu.Load(002000,
+		0013700, 0020100, // MOV @#20100, R0
+	)
+	cpu.R[7] = 002000
+	cpu.step()
+	is.Equal(cpu.R[0], uint16(1))
+	a, ok := cpu.mmu.cached(false, 020100, 0, dspace)
+	is.True(ok)
+	is.Equal(a, addr22(010100))
+	_, ok = cpu.mmu.cached(true, 020100, 0, dspace) // not written
+	is.True(!ok)
+
+	// writing a PAR flushes the tlb
+	cpu.Load(017772342, 0200) // KIPAR1
+	_, ok = cpu.mmu.cached(false, 020100, 0, dspace)
+	is.True(!ok)
+	cpu.R[7] = 002000
+	cpu.step()
+	is.Equal(cpu.R[0], uint16(2))
+
+	// only the blocks within the page length are cached
+	cpu.Load(017772302, 000006) // KIPDR1, one block
+	cpu.R[7] = 002000
+	cpu.step()
+	is.True(cpu.abort)
+	cpu.abort = false
+	cpu.Load(017777572, 1)
+	cpu.Load(002002, 020000)
+	cpu.R[7] = 002000
+	cpu.step()
+	_, ok = cpu.mmu.cached(false, 020000, 0, dspace)
+	is.True(ok)
+	_, ok = cpu.mmu.cached(false, 020100, 0, dspace)
+	is.True(!ok)
+
+	// pages which trap are not cached
+	cpu.Load(017772302, 077404) // KIPDR1, trap on read or write
+	cpu.R[7] = 002000
+	cpu.step()
+	_, ok = cpu.mmu.cached(false, 020000, 0, dspace)
+	is.True(!ok)
+
+	// every page of memory is cached, 140000 included
+	cpu.Load(017777572, 0)             // MMR0, disable the mmu
+	cpu.Load(002000, 0013700, 0140000) // MOV @#140000, R0
+	cpu.R[7] = 002000
+	cpu.step()
+	a, ok = cpu.mmu.cached(false, 0140000, 0, dspace)
+	is.True(ok)
+	is.Equal(a, addr22(0140000))
+}
@@ -0,0 +1,121 @@
+package main
+
+// feature is a set of optional CPU features.
+type feature uint32
+
+const (
+	featEIS     feature = 1 << iota // MUL, DIV, ASH and ASHC
+	feat40                          // SOB, XOR, SXT, MARK and RTT
+	featSPL                         // SPL
+	featMXPS                        // MTPS and MFPS
+	featMXPI                        // MFPI and MTPI
+	featMXPD                        // MFPD and MTPD
+	featFPP                         // FP11 floating point
+	featMMU                         // kernel and user mode memory management
+	featSUPER                       // supervisor mode registers
+	featSPLITID                     // separate I and D space, and SR3
+	feat22BIT                       // 22 bit mapping
+	featUBMAP                       // Unibus map
+	featSTKLIM                      // stack limit register
+	featREGSET                      // two sets of R0-R5
+	featPIRQ                        // program interrupt request register
+	featCPUERR                      // CPU error register
+)
+
+// A model describes the features of a PDP11 CPU model.
+type model struct {
+	name     string
+	features feature
+	mfpt     uint16 // MFPT processor type, zero if MFPT is reserved
+	memsize  addr22 // the largest memory the model can address
+}
+
+// The features of each model follow its processor handbook. Only the 11/45
+// and 11/70 have a stack limit register, and only the 11/44 and 11/70 a CPU
+// error register.
+var models = map[string]*model{
+	"11/20": {
+		name:    "11/20",
+		memsize: 0160000,
+	},
+	"11/40": {
+		name:     "11/40",
+		features: featEIS | feat40 | featMXPI | featMMU,
+		memsize:  0760000,
+	},
+	"11/44": {
+		name:     "11/44",
+		features: featEIS | feat40 | featSPL | featMXPS | featMXPI | featMXPD | featFPP | featMMU | featSUPER | featSPLITID | feat22BIT | featUBMAP | featPIRQ | featCPUERR,
+		mfpt:     1,
+		memsize:  04000000,
+	},
+	"11/45": {
+		name:     "11/45",
+		features: featEIS | feat40 | featSPL | featMXPI | featMXPD | featFPP | featMMU | featSUPER | featSPLITID | featSTKLIM | featREGSET | featPIRQ,
+		memsize:  0760000,
+	},
+	"11/70": {
+		name:     "11/70",
+		features: featEIS | feat40 | featSPL | featMXPI | featMXPD | featFPP | featMMU | featSUPER | featSPLITID | feat22BIT | featUBMAP | featSTKLIM | featREGSET | featPIRQ | featCPUERR,
+		memsize:  iopage,
+	},
+}
+
+// has reports whether the cpu has all the features in f.
+// A KB11 without a model has every feature.
+func (kb *KB11) has(f feature) bool {
+	return kb.model == nil || kb.model.features&f == f
+}
+
+// implemented reports whether the CPU register at the physical address a,
+// if it is one, exists on this model.
+func (kb *KB11) implemented(a addr22) bool {
+	switch {
+	case a == 017777774:
+		return kb.has(featSTKLIM)
+	case a == 017777772:
+		return kb.has(featPIRQ)
+	case a == 017777766:
+		return kb.has(featCPUERR)
+	case a >= 017777572 && a <= 017777576:
+		return kb.has(featMMU)
+	case a >= 017772300 && a < 017772400, a >= 017777600 && a < 017777700:
+		if a&020 == 020 {
+			// D space PDRs and PARs
+			return kb.has(featMMU | featSPLITID)
+		}
+		return kb.has(featMMU)
+	case a >= 017772200 && a < 017772300:
+		if a&020 == 020 {
+			return kb.has(featMMU | featSUPER | featSPLITID)
+		}
+		return kb.has(featMMU | featSUPER)
+	case a == 017772516:
+		return kb.has(featMMU | featSPLITID)
+	case a >= 017770200 && a < 017770400:
+		return kb.has(featUBMAP)
+	default:
+		return true
+	}
+}
+
+// require traps to 10, as a reserved instruction, unless the cpu has all
+// the features in f. An instruction which requires a missing feature has
+// no effect.
+func (kb *KB11) require(f feature) {
+	if !kb.has(f) {
+		kb.trap(INTINVAL)
+	}
+}
+
+// sr3mask returns the SR3 bits implemented by this model.
+func (kb *KB11) sr3mask() uint16 {
+	mask := uint16(SR3UDS | SR3SDS | SR3KDS)
+	if kb.has(feat22BIT) {
+		mask |= SR3MAP22
+	}
+	if kb.has(featUBMAP) {
+		mask |= SR3UBMAP
+	}
+	return mask
+}
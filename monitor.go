@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// HaltError is returned by KB11.Run when the cpu halts.
+type HaltError struct {
+	PC uint16 // the address after the HALT
+}
+
+func (e *HaltError) Error() string { return fmt.Sprintf("halted at %06o", e.PC) }
+
+// A monitor is the console monitor the cpu drops into when it halts.
+//
+// Commands, numbers are octal:
+//
+//	e [addr|reg]        examine the registers, a word of memory or a register
+//	d addr|reg value    deposit value
+//	c                   continue from the PC
+//	s [addr]            reset and start at addr, or the PC
+//	q                   quit
+//
+// Addresses are 22 bit physical addresses of memory, registers are r0-r7,
+// pc and psw. Examining and depositing have no side effects, so the I/O page
+// can not be reached from the monitor.
+type monitor struct {
+	in  <-chan byte
+	out io.Writer
+}
+
+// run reads and executes commands until the cpu should run again, when it
+// returns true, or the user quits.
+func (m *monitor) run(kb *KB11) bool {
+	for {
+		fmt.Fprintf(m.out, "@")
+		line, ok := m.readline()
+		if !ok {
+			return false
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			continue
+		}
+		switch args[0] {
+		case "e":
+			m.examine(kb, args[1:])
+		case "d":
+			m.deposit(kb, args[1:])
+		case "c":
+			return true
+		case "s":
+			if len(args) > 1 {
+				pc, err := strconv.ParseUint(args[1], 8, 16)
+				if err != nil {
+					fmt.Fprintf(m.out, "?%s\r\n", args[1])
+					continue
+				}
+				kb.R[7] = uint16(pc)
+			}
+			kb.start()
+			return true
+		case "q":
+			return false
+		default:
+			fmt.Fprintf(m.out, "?%s\r\n", args[0])
+		}
+	}
+}
+
+// readline reads a line from the console, echoing it.
+func (m *monitor) readline() (string, bool) {
+	var line []byte
+	for c := range m.in {
+		switch c {
+		case '\r', '\n':
+			fmt.Fprintf(m.out, "\r\n")
+			return string(line), true
+		case 010, 0177:
+			if len(line) > 0 {
+				line = line[:len(line)-1]
+				fmt.Fprintf(m.out, "\b \b")
+			}
+		default:
+			line = append(line, c)
+			m.out.Write([]byte{c})
+		}
+	}
+	return "", false
+}
+
+// register returns a pointer to the register named name, if it is one.
+func register(kb *KB11, name string) *uint16 {
+	switch name {
+	case "pc":
+		return &kb.R[7]
+	case "psw":
+		return &kb.psw
+	}
+	if len(name) == 2 && name[0] == 'r' && name[1] >= '0' && name[1] <= '7' {
+		return &kb.R[name[1]-'0']
+	}
+	return nil
+}
+
+func (m *monitor) examine(kb *KB11, args []string) {
+	if len(args) == 0 {
+		fmt.Fprintf(m.out, "R0 %06o R1 %06o R2 %06o R3 %06o R4 %06o R5 %06o R6 %06o R7 %06o PSW %06o\r\n",
+			kb.R[0], kb.R[1], kb.R[2], kb.R[3], kb.R[4], kb.R[5], kb.R[6], kb.R[7], kb.psw)
+		return
+	}
+	if r := register(kb, args[0]); r != nil {
+		fmt.Fprintf(m.out, "%s %06o\r\n", args[0], *r)
+		return
+	}
+	a, err := strconv.ParseUint(args[0], 8, 22)
+	if err != nil {
+		fmt.Fprintf(m.out, "?%s\r\n", args[0])
+		return
+	}
+	v, ok := kb.unibus.peek(addr22(a))
+	if !ok {
+		fmt.Fprintf(m.out, "?%08o\r\n", a)
+		return
+	}
+	fmt.Fprintf(m.out, "%08o %06o\r\n", a, v)
+}
+
+func (m *monitor) deposit(kb *KB11, args []string) {
+	if len(args) != 2 {
+		fmt.Fprintf(m.out, "?d addr value\r\n")
+		return
+	}
+	v, err := strconv.ParseUint(args[1], 8, 16)
+	if err != nil {
+		fmt.Fprintf(m.out, "?%s\r\n", args[1])
+		return
+	}
+	if args[0] == "psw" {
+		kb.writePSW(uint16(v))
+		return
+	}
+	if r := register(kb, args[0]); r != nil {
+		*r = uint16(v)
+		return
+	}
+	a, err := strconv.ParseUint(args[0], 8, 22)
+	if err != nil {
+		fmt.Fprintf(m.out, "?%s\r\n", args[0])
+		return
+	}
+	if !kb.unibus.poke(addr22(a), uint16(v)) {
+		fmt.Fprintf(m.out, "?%08o\r\n", a)
+	}
+}
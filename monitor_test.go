@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestHalt(t *testing.T) {
+	is := is.New(t)
+
+	var cpu KB11
+	cpu.Load(002000, 0000000) // HALT
+	cpu.R[7] = 002000
+	err := cpu.Run()
+	is.Equal(err, &HaltError{PC: 002002})
+}
+
+func TestMonitor(t *testing.T) {
+	is := is.New(t)
+
+	in := make(chan byte, 100)
+	for _, c := range "e 2000\r" + // examine the HALT
+		"d 2000 5200\r" + // INC R0
+		"d r0 16\r" +
+		"e r0\r" +
+		"e 17777566\r" + // the I/O page can not be examined
+		"d 17777566 101\r" +
+		"s 2000\r" + // halts again at 2002
+		"e\r" +
+		"q\r" {
+		in <- byte(c)
+	}
+	var out bytes.Buffer
+	var cpu KB11
+	cpu.monitor = &monitor{in: in, out: &out}
+	cpu.R[7] = 002000
+	cpu.mmu.SR0 = SR0NR // an old abort
+	cpu.pirq = 0001000
+	cpu.fp.fps = FPSD
+	err := cpu.Run()
+	is.NoErr(err)
+	is.Equal(cpu.R[0], uint16(017))
+
+	// starting resets the cpu
+	is.Equal(cpu.mmu.SR0, uint16(0))
+	is.Equal(cpu.pirq, uint16(0))
+	is.Equal(cpu.fp.fps, uint16(0))
+	is.True(strings.Contains(out.String(), "00002000 000000\r\n"))
+	is.True(strings.Contains(out.String(), "r0 000016\r\n"))
+	is.True(strings.Contains(out.String(), "R0 000017 "))
+	is.Equal(strings.Count(out.String(), "?17777566\r\n"), 2)
+	is.Equal(cpu.unibus.cpuerr, uint16(0))
+}
@@ -2,8 +2,10 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"time"
 
 	"github.com/alecthomas/kong"
@@ -12,7 +14,7 @@ import (
 
 func main() {
 	var cli struct {
-		Run runCmd `cmd default:"1" help:"help yourself to a PDP11"`
+		Run runCmd `cmd:"" default:"1" help:"help yourself to a PDP11"`
 	}
 
 	ctx := kong.Parse(&cli)
@@ -23,9 +25,28 @@ func main() {
 type runCmd struct {
 	StartAddr uint16 `name:"startaddr" default:"1026" help:"pc start address in decimal"`
 	RK0       string `name:"rk0" type:"existingfile" help:"path to rk0 image"`
+	RK1       string `name:"rk1" type:"existingfile" help:"path to rk1 image"`
+	RK2       string `name:"rk2" type:"existingfile" help:"path to rk2 image"`
+	RK3       string `name:"rk3" type:"existingfile" help:"path to rk3 image"`
+	RK4       string `name:"rk4" type:"existingfile" help:"path to rk4 image"`
+	RK5       string `name:"rk5" type:"existingfile" help:"path to rk5 image"`
+	RK6       string `name:"rk6" type:"existingfile" help:"path to rk6 image"`
+	RK7       string `name:"rk7" type:"existingfile" help:"path to rk7 image"`
+	ReadOnly  []int  `name:"ro" help:"rk drives to mount read only"`
+	Memory    uint32 `name:"memory" help:"core memory size in KB, defaults to the maximum for the model"`
+	Model     string `name:"model" default:"11/70" enum:"11/20,11/40,11/44,11/45,11/70" help:"cpu model, one of ${enum}"`
 }
 
-func (r *runCmd) Run(ctx *kong.Context) error {
+func (r *runCmd) Run(ctx *kong.Context) (err error) {
+	m := models[r.Model]
+	memsize := addr22(r.Memory) << 10
+	switch {
+	case memsize == 0:
+		memsize = m.memsize
+	case memsize > m.memsize:
+		return fmt.Errorf("memory size %dKB exceeds %dKB for the %s", r.Memory, m.memsize>>10, m.name)
+	}
+
 	fd := os.Stdin.Fd()
 	oldattr, err := tcget(fd)
 	if err != nil {
@@ -41,23 +62,47 @@ func (r *runCmd) Run(ctx *kong.Context) error {
 	check(tcset(fd, &attr))
 
 	cpu := KB11{
+		model:          m,
 		switchregister: 0173030,
 	}
 
+	cpu.unibus.memsize = memsize
 	cpu.unibus.rk11.unibus = &cpu.unibus
 	cpu.unibus.mmu = &cpu.mmu
 	cpu.unibus.cons.Input = make(chan byte, 0)
 	cpu.unibus.lineclock.ticks = time.Tick(999 * time.Millisecond)
 	cpu.Reset()
-	if err := cpu.unibus.rk11.Mount(0, r.RK0); err != nil {
-		return err
+	defer func() {
+		if cerr := cpu.unibus.rk11.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	for unit, path := range []string{r.RK0, r.RK1, r.RK2, r.RK3, r.RK4, r.RK5, r.RK6, r.RK7} {
+		if path == "" {
+			continue
+		}
+		if err := cpu.unibus.rk11.Mount(unit, path, r.readonly(unit)); err != nil {
+			return err
+		}
 	}
+	go signals(&cpu.unibus.rk11, fd, oldattr)
 	cpu.Load(0002000, bootrom[:]...)
 	cpu.R[7] = r.StartAddr
+	cpu.monitor = &monitor{in: cpu.unibus.cons.Input, out: os.Stderr}
 	go stdin(cpu.unibus.cons.Input)
 	return cpu.Run()
 }
 
+// readonly reports whether rk drive unit should be mounted read only.
+func (r *runCmd) readonly(unit int) bool {
+	for _, u := range r.ReadOnly {
+		if u == unit {
+			return true
+		}
+	}
+	return false
+}
+
 func stdin(c chan uint8) {
 	// for _, v := range "rpunix\n" {
 	// 	c <- byte(v)
@@ -72,6 +117,20 @@ func stdin(c chan uint8) {
 	}
 }
 
+// signals syncs the disk images and restores the terminal before exiting
+// on a signal.
+func signals(rk *RK11, fd uintptr, attr *unix.Termios) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, unix.SIGINT, unix.SIGTERM, unix.SIGHUP)
+	s := <-c
+	if err := rk.Sync(); err != nil {
+		fmt.Fprintf(os.Stderr, "rk11: %v\r\n", err)
+	}
+	tcset(fd, attr)
+	fmt.Fprintf(os.Stderr, "\r\n%v\n", s)
+	os.Exit(1)
+}
+
 func check(err error) {
 	if err != nil {
 		log.Fatal(err)
@@ -4,18 +4,57 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io/ioutil"
+	"os"
 )
 
+// RKER bits.
 const (
+	RKDRE = (1 << 15)
 	RKOVR = (1 << 14)
+	RKWLO = (1 << 13)
+	RKNXM = (1 << 10)
 	RKNXD = (1 << 7)
 	RKNXC = (1 << 6)
 	RKNXS = (1 << 5)
+	RKWCE = (1 << 0)
 )
 
+// RKCS bits.
+const (
+	RKCSERR = 1 << 15 // any error
+	RKCSHE  = 1 << 14 // hard error
+	RKCSSCP = 1 << 13 // search complete
+	RKCSIBA = 1 << 11 // inhibit incrementing RKBA
+	RKCSFMT = 1 << 10 // format, transfer only sector headers
+	RKCSSSE = 1 << 8  // stop on soft error
+	RKCSRDY = 1 << 7  // control ready
+	RKCSIDE = 1 << 6  // interrupt on done
+	RKCSMEX = 3 << 4  // bus address bits 17 and 16
+	RKCSGO  = 1 << 0
+)
+
+// RKDS bits.
+const (
+	RKDSRK05 = 1 << 11 // the drive is an RK05
+	RKDSSOK  = 1 << 8  // sector counter ok
+	RKDSDRY  = 1 << 7  // drive ready
+	RKDSRWS  = 1 << 6  // read/write/seek ready
+	RKDSWPS  = 1 << 5  // write protected
+)
+
+// seeksteps is how many steps an RK05 takes to move its heads one cylinder.
+const seeksteps = 10
+
 type RK05 struct {
-	buf []byte
-	pos uint32
+	buf  []byte
+	pos  uint32
+	file *os.File // the image buf was read from, if any
+
+	readonly bool // mounted read only
+	locked   bool // write locked until a drive reset
+
+	cylinder uint32 // the cylinder the heads are over
+	seeking  int    // steps until the seek in progress completes
 }
 
 func (rk *RK05) write16(v uint16) {
@@ -29,54 +68,189 @@ func (rk *RK05) read16() uint16 {
 	return v
 }
 
+// writeback writes the image from off up to the current position through
+// to its file.
+func (rk *RK05) writeback(off uint32) error {
+	if rk.file == nil {
+		return nil
+	}
+	_, err := rk.file.WriteAt(rk.buf[off:rk.pos], int64(off))
+	return err
+}
+
+// sync commits the image file to stable storage.
+func (rk *RK05) sync() error {
+	if rk.file == nil {
+		return nil
+	}
+	return rk.file.Sync()
+}
+
+// close syncs and closes the image file.
+func (rk *RK05) close() error {
+	if rk.file == nil {
+		return nil
+	}
+	err := rk.file.Sync()
+	if cerr := rk.file.Close(); err == nil {
+		err = cerr
+	}
+	rk.file = nil
+	return err
+}
+
+// mounted reports whether the drive has a pack in it.
+func (rk *RK05) mounted() bool { return rk.buf != nil }
+
+// protected reports whether writes to the drive are refused.
+func (rk *RK05) protected() bool { return rk.readonly || rk.locked }
+
+// seek starts moving the heads to cylinder.
+func (rk *RK05) seek(cylinder uint32) {
+	n := cylinder - rk.cylinder
+	if cylinder < rk.cylinder {
+		n = rk.cylinder - cylinder
+	}
+	rk.cylinder = cylinder
+	rk.seeking = 1 + int(n)*seeksteps
+}
+
 type RK11 struct {
-	rkds, rker, rkcs, rkwc, rkba, rkda uint16
-	drive, sector, surface, cylinder   uint32
+	rker, rkcs, rkwc, rkba, rkda     uint16
+	rkmr, rkdb                       uint16
+	drive, sector, surface, cylinder uint32
+
+	id      uint16 // the drive RKDS describes
+	seeking uint8  // the drives with a seek in progress
 
 	units [8]RK05
 
 	unibus *UNIBUS
 }
 
-func (rk *RK11) Mount(unit int, path string) error {
-	buf, err := ioutil.ReadFile(path)
+// Mount mounts the image at path on drive unit. Writes to the drive go
+// through to the image as each sector is written, unless it is mounted
+// read only, when they fail with a write lock error.
+func (rk *RK11) Mount(unit int, path string, readonly bool) error {
+	if unit < 0 || unit >= len(rk.units) {
+		return fmt.Errorf("rk11: no drive %d", unit)
+	}
+	flag := os.O_RDWR
+	if readonly {
+		flag = os.O_RDONLY
+	}
+	f, err := os.OpenFile(path, flag, 0)
 	if err != nil {
 		return err
 	}
-	rk.units[unit].buf = buf
+	buf, err := ioutil.ReadAll(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	d := &rk.units[unit]
+	if err := d.close(); err != nil {
+		f.Close()
+		return err
+	}
+	d.buf = buf
+	d.file = f
+	d.readonly = readonly
+	d.locked = false
 	return nil
 }
 
-func (rk *RK11) read16(a addr18) uint16 {
+// Sync commits the mounted images to stable storage.
+func (rk *RK11) Sync() error {
+	var err error
+	for i := range rk.units {
+		if serr := rk.units[i].sync(); err == nil {
+			err = serr
+		}
+	}
+	return err
+}
+
+// Close syncs and closes the mounted images.
+func (rk *RK11) Close() error {
+	var err error
+	for i := range rk.units {
+		if cerr := rk.units[i].close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// rkds returns the drive status of drive id.
+func (rk *RK11) rkds() uint16 {
+	v := rk.id<<13 | RKDSRK05 | RKDSSOK
+	if d := &rk.units[rk.id]; d.mounted() {
+		v |= RKDSDRY
+		if d.seeking == 0 {
+			v |= RKDSRWS
+		}
+		if d.protected() {
+			v |= RKDSWPS
+		}
+	}
+	return v
+}
+
+func (rk *RK11) read16(a addr18) (uint16, bool) {
 	//fmt.Printf("rk11:read16: %06o\n", a)
 	switch a {
 	case 0777400:
 		// 777400 Drive Status
-		return rk.rkds
+		return rk.rkds(), true
 	case 0777402:
 		// 777402 Error Register
-		return rk.rker
+		return rk.rker, true
 	case 0777404:
 		// 777404 Control Status
-		return rk.rkcs & 0xfffe // go bit is write only
-	// case 0777406:
-	// 	// 777406 Word Count
-	// 	return rk.rkwc
+		v := rk.rkcs &^ RKCSGO // go bit is write only
+		if rk.rker != 0 {
+			v |= RKCSERR
+		}
+		if rk.rker&0177740 != 0 {
+			v |= RKCSHE
+		}
+		return v, true
+	case 0777406:
+		// 777406 Word Count
+		return rk.rkwc, true
+	case 0777410:
+		// 777410 Bus Address
+		return rk.rkba, true
 	case 0777412:
-		return rk.rkda
+		// 777412 Disk Address
+		return rk.rkda, true
+	case 0777414:
+		// 777414 Maintenance
+		return rk.rkmr, true
+	case 0777416:
+		// 777416 Data Buffer, the last word transferred
+		return rk.rkdb, true
 	default:
-		fmt.Printf("rk11::read16 invalid read %06o\n", a)
-		panic(trap{INTBUS})
+		return 0, false
 	}
 }
 
-func (rk *RK11) write16(a addr18, v uint16) {
+func (rk *RK11) write16(a addr18, v uint16) bool {
 	// fmt.Printf("rk11:write16: %06o %06o\n", a, v)
 	switch a {
+	case 0777400, 0777402, 0777416:
+		// RKDS, RKER and RKDB are read only
 	case 0777404:
 		// RKCS
 		rk.rkcs &= 0xf080
 		rk.rkcs |= v & ^uint16(0xf080) // Bits 7 and 12 - 15 are read only
+		if v&RKCSGO == RKCSGO {
+			// starting a function clears ready, search complete and
+			// the errors of the last function
+			rk.rkcs &^= RKCSRDY | RKCSSCP
+			rk.rker = 0
+		}
 	case 0777406:
 		// RKWC
 		rk.rkwc = v
@@ -90,95 +264,243 @@ func (rk *RK11) write16(a addr18, v uint16) {
 		rk.cylinder = uint32(v>>5) & 0377
 		rk.surface = uint32(v>>4) & 1
 		rk.sector = uint32(v & 15)
+		rk.id = v >> 13
+	case 0777414:
+		// RKMR, the maintenance functions are not emulated
+		rk.rkmr = v
 	default:
-		fmt.Printf("rk11::write16 invalid write %06o: %06o\n", a, v)
-		panic(trap{INTBUS})
+		return false
 	}
+	return true
 }
 
-func (rk *RK11) rknotready() {
-	// fmt.Println("rk11: not ready")
-	rk.rkds &^= 1 << 6
-	rk.rkcs &^= 1 << 7
+func (rk *RK11) _go() bool {
+	return rk.rkcs&RKCSGO == RKCSGO
 }
 
-func (rk *RK11) rkready() {
-	// fmt.Println("rk11: ready")
-	rk.rkds |= 1 << 6
-	rk.rkcs |= 1 << 7
-	rk.rkcs &^= 1 // no go
+// busy reports whether the controller is performing a function or a drive
+// is seeking. A drive whose seek waits for search complete to be serviced
+// is not busy.
+func (rk *RK11) busy() bool {
+	if rk._go() {
+		return true
+	}
+	for i := range rk.units {
+		if s := rk.units[i].seeking; s > 1 || s == 1 && rk.rkcs&RKCSSCP == 0 {
+			return true
+		}
+	}
+	return false
 }
 
-func (rk *RK11) _go() bool {
-	return rk.rkcs&1 == 1
+// ba returns the 18 bit bus address of the transfer, RKBA extended by the
+// MEX bits of RKCS.
+func (rk *RK11) ba() addr18 {
+	return addr18(rk.rkcs&RKCSMEX)<<12 | addr18(rk.rkba)
+}
+
+// incba advances the bus address a word, carrying into the MEX bits,
+// unless incrementing is inhibited.
+func (rk *RK11) incba() {
+	if rk.rkcs&RKCSIBA == RKCSIBA {
+		return
+	}
+	a := rk.ba() + 2
+	rk.rkba = uint16(a)
+	rk.rkcs = rk.rkcs&^RKCSMEX | uint16(a>>12)&RKCSMEX
 }
 
-func (rk *RK11) step() {
+// done ends the current function and returns the interrupt it raises, if
+// any.
+func (rk *RK11) done() interrupt {
+	rk.rkcs = rk.rkcs&^RKCSGO | RKCSRDY
+	if rk.rkcs&RKCSIDE == RKCSIDE {
+		return interrupt{INTRK, 5}
+	}
+	return interrupt{}
+}
+
+// error ends the current function with the RKER bits err.
+func (rk *RK11) error(err uint16) interrupt {
+	rk.rker |= err
+	return rk.done()
+}
+
+// step advances the seeks in progress and performs the current function,
+// if the GO bit is set, and returns the interrupt it raises, if any.
+func (rk *RK11) step() interrupt {
+	if rk.seeking != 0 {
+		if i := rk.seeks(); i.vec != 0 {
+			return i
+		}
+	}
 	if !rk._go() {
 		// no GO bit
-		return
+		return interrupt{}
 	}
 
 	switch (rk.rkcs >> 1) & 7 {
 	case 0:
 		// controller reset
 		rk.reset()
-	case 1, 2, 3: // write, read, check
-		if rk.drive != 0 {
-			rk.rker |= 0x8080 // NXD
-			break
+	case 1, 2, 3, 5: // write, read, write check, read check
+		if err := rk.check(); err != 0 {
+			return rk.error(err)
 		}
-		if rk.cylinder > 0312 {
-			rk.rker |= 0x8040 // NXC
-			break
+		if rk.units[rk.drive].seeking > 0 {
+			// wait for the drive to finish seeking
+			return interrupt{}
 		}
-		if rk.sector > 013 {
-			rk.rker |= 0x8020 // NXS
-			break
+		if (rk.rkcs>>1)&7 == 1 && rk.units[rk.drive].protected() {
+			return rk.error(RKWLO)
+		}
+		if !rk.seek() {
+			// the disk address is beyond the end of the image
+			return rk.error(RKOVR)
+		}
+		return rk.readwrite()
+	case 4: // Seek - the drive seeks while the controller is free
+		if err := rk.check(); err != 0 {
+			return rk.error(err)
+		}
+		return rk.startseek(rk.cylinder)
+	case 6: // Drive Reset - seeks to cylinder 0
+		if !rk.units[rk.drive].mounted() {
+			return rk.error(RKNXD)
+		}
+		rk.units[rk.drive].locked = false
+		return rk.startseek(0)
+	case 7: // Write Lock - protects the drive until a drive reset
+		if !rk.units[rk.drive].mounted() {
+			return rk.error(RKNXD)
+		}
+		rk.units[rk.drive].locked = true
+		return rk.done()
+	}
+	return interrupt{}
+}
+
+// startseek starts the selected drive seeking to cylinder, once it has
+// finished any seek in progress, and ends the function.
+func (rk *RK11) startseek(cylinder uint32) interrupt {
+	d := &rk.units[rk.drive]
+	if d.seeking > 0 {
+		return interrupt{}
+	}
+	d.seek(cylinder)
+	rk.seeking |= 1 << rk.drive
+	return rk.done()
+}
+
+// seeks advances the seeks in progress. When a drive finishes seeking RKCS
+// reports search complete and RKDS describes the drive. Both stay latched
+// until the next function starts, so until then no other drive finishes
+// and there is only ever one search complete interrupt pending.
+func (rk *RK11) seeks() interrupt {
+	done := -1
+	for i := range rk.units {
+		d := &rk.units[i]
+		switch {
+		case d.seeking > 1:
+			d.seeking--
+		case d.seeking == 1 && done < 0 && rk.rkcs&RKCSSCP == 0:
+			d.seeking = 0
+			done = i
 		}
-		rk.rknotready()
-		rk.seek()
-		rk.readwrite()
-	case 6: // Drive Reset - falls through to be finished as a seek
-		rk.rker = 0
-		fallthrough
-	case 4: // Seek (and drive reset) - complete immediately
-		rk.seek()
-		rk.rkcs &= ^uint16(0x2000) // Clear search complete - reset by rk11_seekEnd
-		rk.rkcs |= 0x80            // set done - ready to accept new command
-		panic(interrupt{INTRK, 5})
-	case 5: // Read Check
-		break
-	case 7: // Write Lock - not implemented :-(
-		break
+	}
+	if done < 0 {
+		return interrupt{}
+	}
+	rk.seeking &^= 1 << done
+	rk.id = uint16(done)
+	rk.rkcs |= RKCSSCP
+	if rk.rkcs&RKCSIDE == RKCSIDE {
+		return interrupt{INTRK, 5}
+	}
+	return interrupt{}
+}
+
+// check checks the disk address in RKDA, returning the RKER bits for
+// any errors.
+func (rk *RK11) check() uint16 {
+	switch {
+	case !rk.units[rk.drive].mounted():
+		return RKNXD
+	case rk.cylinder > 0312:
+		return RKNXC
+	case rk.sector > 013:
+		return RKNXS
 	default:
-		panic(fmt.Sprintf("unimplemented RK05 operation %06o\n", ((rk.rkcs & 017) >> 1)))
+		return 0
 	}
 }
 
-func (rk *RK11) readwrite() {
+// readwrite transfers a sector, or what is left of the transfer if that is
+// less. Write check compares the sector with memory and read check only
+// reads it. In format mode only the sector header, its cylinder address,
+// is transferred.
+func (rk *RK11) readwrite() interrupt {
 	if rk.rkwc == 0 {
-		rk.rkready()
-		if rk.rkcs&(1<<6) > 0 {
-			panic(interrupt{INTRK, 5})
-		}
-		return
+		return rk.done()
 	}
 
-	w := ((rk.rkcs >> 1) & 7) == 1
-	// fmt.Printf("rk11: step: RKCS: %06o RKBA: %06o RKWC: %06o cylinder: %03o surface: %03o sector: %03o write: %v rker: %06o\n", rk.rkcs, rk.rkba, rk.rkwc, rk.cylinder, rk.surface, rk.sector, w, rk.rker)
+	fn := (rk.rkcs >> 1) & 7
+	// fmt.Printf("rk11: step: RKCS: %06o RKBA: %06o RKWC: %06o cylinder: %03o surface: %03o sector: %03o function: %o rker: %06o\n", rk.rkcs, rk.rkba, rk.rkwc, rk.cylinder, rk.surface, rk.sector, fn, rk.rker)
 
-	for i := 0; i < 256 && rk.rkwc != 0; i++ {
-		if w {
-			val := rk.unibus.read16(addr18(rk.rkba))
-			rk.units[rk.drive].write16(val)
-		} else {
-			val := rk.units[rk.drive].read16()
-			rk.unibus.write16(addr18(rk.rkba), val)
+	d := &rk.units[rk.drive]
+	start := d.pos
+	format := rk.rkcs&RKCSFMT == RKCSFMT
+	n := 256
+	if format {
+		n = 1
+	}
+	var err uint16
+	for i := 0; i < n && rk.rkwc != 0 && err == 0; i++ {
+		if !format && d.pos+2 > uint32(len(d.buf)) {
+			// the transfer ran off the end of the image
+			err = RKOVR
+			break
+		}
+		ok := true
+		switch fn {
+		case 1: // write
+			if rk.rkdb, ok = rk.unibus.dmaread16(rk.ba()); ok && !format {
+				d.write16(rk.rkdb)
+			}
+		case 2: // read
+			rk.rkdb = rk.next(d, format)
+			ok = rk.unibus.dmawrite16(rk.ba(), rk.rkdb)
+		case 3: // write check
+			var val uint16
+			if val, ok = rk.unibus.dmaread16(rk.ba()); ok {
+				if rk.rkdb = rk.next(d, format); val != rk.rkdb {
+					rk.rker |= RKWCE
+					if rk.rkcs&RKCSSSE == RKCSSSE {
+						// stop on soft error
+						err = RKWCE
+					}
+				}
+			}
+		case 5: // read check
+			rk.rkdb = rk.next(d, format)
+		}
+		if !ok {
+			// non-existent memory, abandon the transfer
+			err = RKNXM
+			break
 		}
-		rk.rkba += 2
+		rk.incba()
 		rk.rkwc++
 	}
+	if fn == 1 {
+		if werr := d.writeback(start); werr != nil {
+			fmt.Fprintf(os.Stderr, "rk11: drive %d: %v\r\n", rk.drive, werr)
+			err = RKDRE
+		}
+	}
+	if err != 0 {
+		return rk.error(err)
+	}
 	rk.sector++
 	if rk.sector > 013 {
 		rk.sector = 0
@@ -186,31 +508,48 @@ func (rk *RK11) readwrite() {
 		if rk.surface > 1 {
 			rk.surface = 0
 			rk.cylinder++
-			if rk.cylinder > 0312 {
-				rk.rker |= RKOVR
-				return
-			}
 		}
 	}
+	rk.rkda = uint16(rk.drive<<13 | rk.cylinder<<5 | rk.surface<<4 | rk.sector)
+	if rk.rkwc == 0 {
+		return rk.done()
+	}
+	if rk.cylinder > 0312 {
+		// the transfer continues past the last cylinder
+		return rk.error(RKOVR)
+	}
+	return interrupt{}
 }
 
-func (rk *RK11) seek() {
-	rk.units[rk.drive].pos = (rk.cylinder*24 + rk.surface*12 + rk.sector) * 512
-	if rk.units[rk.drive].pos > uint32(len(rk.units[rk.drive].buf)) {
-		panic(fmt.Sprintf("rkstep: failed to seek\n"))
+// next returns the next word of the sector, or in format mode its header.
+func (rk *RK11) next(d *RK05, format bool) uint16 {
+	if format {
+		return uint16(rk.cylinder << 5)
 	}
+	return d.read16()
+}
+
+// seek positions the drive at the disk address of the transfer. It returns
+// false if the address is beyond the end of the image.
+func (rk *RK11) seek() bool {
+	d := &rk.units[rk.drive]
+	d.cylinder = rk.cylinder
+	d.pos = (rk.cylinder*24 + rk.surface*12 + rk.sector) * 512
+	return d.pos < uint32(len(d.buf))
 }
 
 func (rk *RK11) reset() {
 	fmt.Println("rk11: reset")
-	rk.rkds = 04700 // Set bits 6, 7, 8, 11
 	rk.rker = 0
-	rk.rkcs = 0200
+	rk.rkcs = RKCSRDY
 	rk.rkwc = 0
 	rk.rkba = 0
 	rk.rkda = 0
+	rk.rkmr = 0
+	rk.rkdb = 0
 	rk.drive = 0
 	rk.cylinder = 0
 	rk.surface = 0
 	rk.sector = 0
+	rk.id = 0
 }
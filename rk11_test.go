@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+// rkimage returns an RK05 image of n sectors with each word holding its
+// sector number plus tag.
+func rkimage(n int, tag uint16) []byte {
+	buf := make([]byte, n*512)
+	for i := 0; i < len(buf); i += 2 {
+		v := uint16(i/512) + tag
+		buf[i] = byte(v)
+		buf[i+1] = byte(v >> 8)
+	}
+	return buf
+}
+
+// rktest returns a cpu with a reset RK11 and no drives mounted.
+func rktest() (*KB11, *RK11) {
+	cpu := new(KB11)
+	cpu.unibus.mmu = &cpu.mmu
+	rk := &cpu.unibus.rk11
+	rk.unibus = &cpu.unibus
+	rk.reset()
+	return cpu, rk
+}
+
+// rkrun runs the function fn, with the RKCS bits cs, on the disk address
+// da, transferring wc words to or from ba. It returns the interrupts raised
+// before the controller is ready.
+func rkrun(rk *RK11, fn, cs, da, ba uint16, wc int) int {
+	rk.write16(0777412, da)
+	rk.write16(0777410, ba)
+	rk.write16(0777406, uint16(-wc))
+	rk.write16(0777404, cs|fn<<1|RKCSGO)
+	return rkwait(rk)
+}
+
+// rkwait steps the RK11 until the controller is ready, returning the
+// interrupts raised.
+func rkwait(rk *RK11) (n int) {
+	for rk.rkcs&RKCSRDY == 0 {
+		if rk.step().vec == INTRK {
+			n++
+		}
+	}
+	return n
+}
+
+// rkread returns the RK11 register at a.
+func rkread(is *is.I, rk *RK11, a addr18) uint16 {
+	v, ok := rk.read16(a)
+	is.True(ok)
+	return v
+}
+
+func TestRKDrives(t *testing.T) {
+	is := is.New(t)
+	cpu, rk := rktest()
+	rk.units[0].buf = rkimage(24, 0)
+	rk.units[1].buf = rkimage(24, 0100)
+
+	// read sector 1 of drive 1
+	is.Equal(rkrun(rk, 2, RKCSIDE, 1<<13|1, 001000, 256), 1)
+	is.Equal(cpu.unibus.core[001000>>1], uint16(0101))
+	is.Equal(rkread(is, rk, 0777402), uint16(0))
+
+	// drive 2 is not mounted
+	is.Equal(rkrun(rk, 2, RKCSIDE, 2<<13, 001000, 256), 1)
+	is.Equal(rkread(is, rk, 0777402), uint16(RKNXD))
+	is.Equal(rkread(is, rk, 0777404)&(RKCSERR|RKCSHE), uint16(RKCSERR|RKCSHE))
+	is.Equal(rkread(is, rk, 0777400)&(RKDSDRY|RKDSRWS), uint16(0))
+
+	// drive 1 seeks to cylinder 10 while drive 0 transfers
+	is.Equal(rkrun(rk, 4, RKCSIDE, 1<<13|10<<5, 0, 0), 1) // the controller is free at once
+	is.Equal(rkread(is, rk, 0777400)>>13, uint16(1))
+	is.Equal(rkread(is, rk, 0777400)&(RKDSDRY|RKDSRWS), uint16(RKDSDRY))
+
+	is.Equal(rkrun(rk, 2, RKCSIDE, 0<<13|2, 002000, 256), 1)
+	is.Equal(cpu.unibus.core[002000>>1], uint16(2))
+	is.True(rk.units[1].seeking > 0)
+	is.Equal(rkread(is, rk, 0777404)&RKCSSCP, uint16(0))
+
+	// then drive 1 completes its search
+	var n int
+	for rk.units[1].seeking > 0 {
+		if rk.step().vec == INTRK {
+			n++
+		}
+	}
+	is.Equal(n, 1)
+	is.Equal(rkread(is, rk, 0777404)&RKCSSCP, uint16(RKCSSCP))
+	is.Equal(rkread(is, rk, 0777400)>>13, uint16(1))
+	is.Equal(rkread(is, rk, 0777400)&(RKDSDRY|RKDSRWS), uint16(RKDSDRY|RKDSRWS))
+
+	// seeks on all eight drives complete one at a time, as search complete
+	// and the drive RKDS describes stay latched until a function starts
+	for i := uint16(0); i < 8; i++ {
+		rk.units[i].buf = rkimage(24, 0)
+		is.Equal(rkrun(rk, 4, RKCSIDE, i<<13|5<<5, 0, 0), 1)
+	}
+	seen := make(map[uint16]bool)
+	for len(seen) < 8 {
+		for rk.rkcs&RKCSSCP == 0 {
+			rk.step()
+		}
+		id := rkread(is, rk, 0777400) >> 13
+		is.True(!seen[id])
+		seen[id] = true
+		for i := 0; i < 1000; i++ {
+			is.Equal(rk.step(), interrupt{})
+		}
+		is.Equal(rkread(is, rk, 0777400)>>13, id)
+		rkrun(rk, 7, RKCSIDE, 0, 0, 0) // write lock drive 0
+	}
+	is.Equal(rk.seeking, uint8(0))
+}
+
+func TestRKWriteThrough(t *testing.T) {
+	is := is.New(t)
+	cpu, rk := rktest()
+
+	path := filepath.Join(t.TempDir(), "rk0")
+	is.NoErr(ioutil.WriteFile(path, rkimage(24, 0), 0644))
+	is.NoErr(rk.Mount(0, path, false))
+	defer rk.Close()
+
+	for i := 0; i < 256; i++ {
+		cpu.Load(addr22(001000+i*2), 0177000+uint16(i))
+	}
+	rkrun(rk, 1, 0, 3, 001000, 256) // write sector 3
+	is.Equal(rk.rker, uint16(0))
+
+	// the sector is in the file before the image is closed
+	buf, err := ioutil.ReadFile(path)
+	is.NoErr(err)
+	is.Equal(binary.LittleEndian.Uint16(buf[3*512:]), uint16(0177000))
+	is.Equal(binary.LittleEndian.Uint16(buf[4*512-2:]), uint16(0177377))
+	is.Equal(binary.LittleEndian.Uint16(buf[4*512:]), uint16(4))
+
+	is.NoErr(rk.Close())
+	is.True(rk.units[0].file == nil)
+}
+
+func TestRKWriteLock(t *testing.T) {
+	is := is.New(t)
+	_, rk := rktest()
+
+	dir := t.TempDir()
+	for _, name := range []string{"rk0", "rk1"} {
+		is.NoErr(ioutil.WriteFile(filepath.Join(dir, name), rkimage(24, 0), 0644))
+	}
+	is.NoErr(rk.Mount(0, filepath.Join(dir, "rk0"), false))
+	is.NoErr(rk.Mount(1, filepath.Join(dir, "rk1"), true))
+	defer rk.Close()
+
+	// run runs fn on drive and returns RKER and the RKDS write protect bit
+	run := func(drive, fn uint16) (rker, wps uint16) {
+		rkrun(rk, fn, 0, drive<<13, 001000, 256)
+		return rk.rker, rkread(is, rk, 0777400) & RKDSWPS
+	}
+
+	// drive 1 is mounted read only
+	is.True(rk.units[1].readonly)
+	rker, wps := run(1, 1)
+	is.Equal(rker, uint16(RKWLO))
+	is.Equal(wps, uint16(RKDSWPS))
+	rker, _ = run(1, 2) // reads are fine
+	is.Equal(rker, uint16(0))
+
+	// Write Lock protects drive 0 until a drive reset
+	rker, wps = run(0, 1)
+	is.Equal(rker, uint16(0))
+	is.Equal(wps, uint16(0))
+	run(0, 7)
+	rker, wps = run(0, 1)
+	is.Equal(rker, uint16(RKWLO))
+	is.Equal(wps, uint16(RKDSWPS))
+	run(0, 6)
+	rker, wps = run(0, 1)
+	is.Equal(rker, uint16(0))
+	is.Equal(wps, uint16(0))
+
+	// a drive reset does not unlock a read only mount
+	run(1, 6)
+	rker, _ = run(1, 1)
+	is.Equal(rker, uint16(RKWLO))
+}
+
+func TestRKChecks(t *testing.T) {
+	is := is.New(t)
+	cpu, rk := rktest()
+	rk.units[0].buf = rkimage(24, 0)
+
+	// run runs fn on the disk address da with the RKCS bits cs,
+	// transferring wc words to or from 1000, and returns the interrupts
+	run := func(da, fn, cs uint16, wc int) int {
+		return rkrun(rk, fn, cs|RKCSIDE, da, 001000, wc)
+	}
+	rkcs := func() uint16 {
+		return rkread(is, rk, 0777404) & (RKCSERR | RKCSHE)
+	}
+
+	for i := 0; i < 256; i++ {
+		cpu.Load(addr22(001000+i*2), 5)
+	}
+
+	// write check sector 5
+	is.Equal(run(5, 3, 0, 256), 1)
+	is.Equal(rk.rker, uint16(0))
+	cpu.Load(001776, 4)
+	is.Equal(run(5, 3, 0, 256), 1)
+	is.Equal(rk.rker, uint16(RKWCE))
+	is.Equal(rkcs(), uint16(RKCSERR)) // a soft error
+	is.Equal(rk.rkwc, uint16(0))
+
+	// stop on soft error ends the transfer at the mismatch
+	cpu.Load(001010, 4)
+	is.Equal(run(5, 3, RKCSSSE, 256), 1)
+	is.Equal(rk.rker, uint16(RKWCE))
+	is.Equal(rk.rkba, uint16(001012))
+
+	// read check leaves memory alone
+	is.Equal(run(6, 5, 0, 256), 1)
+	is.Equal(rk.rker, uint16(0))
+	is.Equal(cpu.unibus.core[001000>>1], uint16(5))
+	is.Equal(rk.rkwc, uint16(0))
+
+	// bad disk addresses
+	for _, tt := range []struct {
+		da   uint16
+		rker uint16
+	}{
+		{0313 << 5, RKNXC},
+		{014, RKNXS},
+		{1 << 13, RKNXD},
+		{1 << 5, RKOVR}, // beyond the end of the image
+		{033, RKOVR},    // the transfer runs off the end of the image
+	} {
+		is.Equal(run(tt.da, 2, 0, 512), 1)
+		is.Equal(rk.rker, tt.rker)
+		is.Equal(rkcs(), uint16(RKCSERR|RKCSHE))
+	}
+
+	// the next function clears the errors
+	is.Equal(run(0, 2, 0, 256), 1)
+	is.Equal(rk.rker, uint16(0))
+	is.Equal(rkcs(), uint16(0))
+
+	// reading the last sector of a full disk is not an overrun
+	rk.units[0].buf = rkimage(0313*24, 0)
+	is.Equal(run(0312<<5|1<<4|013, 2, 0, 256), 1)
+	is.Equal(rk.rker, uint16(0))
+	is.Equal(rk.rkwc, uint16(0))
+	is.Equal(cpu.unibus.core[001000>>1], uint16(0313*24-1))
+
+	// but carrying on past it is
+	is.Equal(run(0312<<5|1<<4|013, 2, 0, 512), 1)
+	is.Equal(rk.rker, uint16(RKOVR))
+	is.Equal(rk.rkwc, uint16(0177400))
+}
+
+func TestRKRegisters(t *testing.T) {
+	is := is.New(t)
+	cpu, rk := rktest()
+	rk.units[0].buf = rkimage(48, 0)
+
+	// run reads wc words from da to ba with the RKCS bits cs
+	run := func(da, ba, cs uint16, wc int) {
+		rkrun(rk, 2, cs, da, ba, wc)
+		is.Equal(rk.rker, uint16(0))
+	}
+
+	for a, v := range map[addr18]uint16{0777406: 0177400, 0777410: 0123456, 0777412: 000123, 0777414: 0777} {
+		is.True(rk.write16(a, v))
+		is.Equal(rkread(is, rk, a), v)
+	}
+	// RKDS, RKER and RKDB are read only
+	is.True(rk.write16(0777400, 0177777))
+	is.True(rk.write16(0777402, 0177777))
+	is.True(rk.write16(0777416, 0177777))
+	is.Equal(rkread(is, rk, 0777402), uint16(0))
+	is.Equal(rkread(is, rk, 0777416), uint16(0))
+
+	// the MEX bits extend the bus address to 18 bits
+	run(1, 001000, 1<<4, 256)
+	is.Equal(cpu.unibus.core[0201000>>1], uint16(1))
+	is.Equal(cpu.unibus.core[001000>>1], uint16(0))
+	is.Equal(rkread(is, rk, 0777412), uint16(2)) // the next sector
+	is.Equal(rkread(is, rk, 0777416), uint16(1)) // the last word transferred
+
+	// and RKBA carries into them
+	run(2, 0177000, 0, 512)
+	is.Equal(cpu.unibus.core[0177000>>1], uint16(2))
+	is.Equal(cpu.unibus.core[0200000>>1], uint16(3))
+	is.Equal(rkread(is, rk, 0777410), uint16(001000))
+	is.Equal(rkread(is, rk, 0777404)&RKCSMEX, uint16(1<<4))
+	is.Equal(rkread(is, rk, 0777406), uint16(0))
+
+	// inhibit incrementing transfers every word to the same address
+	run(4, 002000, RKCSIBA, 256)
+	is.Equal(rkread(is, rk, 0777410), uint16(002000))
+	is.Equal(cpu.unibus.core[002000>>1], uint16(4))
+	is.Equal(cpu.unibus.core[002002>>1], uint16(0))
+
+	// format transfers one header per sector
+	run(1<<5|013, 003000, RKCSFMT, 3)
+	is.Equal(cpu.unibus.core[003000>>1:003006>>1], []uint16{040, 040, 040})
+	is.Equal(rkread(is, rk, 0777412), uint16(1<<5|1<<4|2))
+}
@@ -9,6 +9,8 @@ const (
 	INTIOT    = 0020
 	INTTTYIN  = 0060
 	INTTTYOUT = 0064
+	INTPIRQ   = 0240
+	INTFPP    = 0244
 	INTFAULT  = 0250
 	INTCLOCK  = 0100
 	INTRK     = 0220
@@ -22,12 +24,3 @@ type interrupt struct {
 func (i interrupt) String() string {
 	return fmt.Sprintf("interrupt: %06o, pri: %03o", i.vec, i.pri)
 }
-
-// Trap is a PDP11 trap.
-type trap struct {
-	vec uint16
-}
-
-func (t trap) String() string {
-	return fmt.Sprintf("trap: %06o", t.vec)
-}
@@ -5,12 +5,31 @@ import "fmt"
 // addr18 is an 18 bit unibus address.
 type addr18 uint32
 
-// UNIBUS is a PDP11 UNIBUS 18 bus.
+// addr22 is a 22 bit physical address.
+type addr22 uint32
+
+// iopage is the physical address of the I/O page, the top 4 KW of the 22 bit
+// address space. In 18 bit mode the I/O page at 760000 is relocated here.
+const iopage addr22 = 017760000
+
+// UNIBUS is a PDP11 UNIBUS 18 bus, and the 22 bit memory bus behind it.
 type UNIBUS struct {
 
-	// 128 KW of core memory minus 4 KW of io page.
-	// [000000, 760000)
-	core [(128 - 4) << 10]uint16
+	// 2 MW of core memory minus 4 KW of io page.
+	// [00000000, 17760000)
+	core [(2048 - 4) << 10]uint16
+
+	// memsize is the size of core memory in bytes. If zero, 124 KW,
+	// the memory reachable with 18 bit addresses, is present.
+	memsize addr22
+
+	// ubmap holds the 31 Unibus map registers. Each relocates 8 KB of
+	// the Unibus address space into the 22 bit physical address space.
+	ubmap [31]addr22
+
+	// cpuerr is the CPU error register at 777766. It records why the
+	// last traps to 4 happened until it is written.
+	cpuerr uint16
 
 	rk11      RK11
 	cons      KL11
@@ -18,68 +37,211 @@ type UNIBUS struct {
 	lineclock KW11
 }
 
-// read16 reads addr from the UNIBUS.
-func (u *UNIBUS) read16(addr addr18) uint16 {
-	// fmt.Printf("unibus: read16: %06o\n", addr)
-	if addr < 0760000 {
-		return u.core[addr>>1]
+// memtop returns the physical address of the end of core memory.
+func (u *UNIBUS) memtop() addr22 {
+	if u.memsize == 0 {
+		return 0760000
+	}
+	return u.memsize
+}
+
+// CPU error register bits.
+const (
+	CPUERRRED     = 1 << 2 // red zone stack limit
+	CPUERRYELLOW  = 1 << 3 // yellow zone stack limit
+	CPUERRTIMEOUT = 1 << 4 // Unibus timeout
+	CPUERRNXM     = 1 << 5 // non-existent memory
+	CPUERRODD     = 1 << 6 // odd address
+	CPUERRHALT    = 1 << 7 // illegal halt
+)
+
+// buserror records cause in the CPU error register. It returns false so a
+// failed access can return its result.
+func (u *UNIBUS) buserror(cause uint16) bool {
+	u.cpuerr |= cause
+	return false
+}
+
+// peek returns the word of memory at the physical address pa for
+// inspection. It has no side effects, so only memory can be read. If pa is
+// odd or beyond the end of memory peek returns false.
+func (u *UNIBUS) peek(pa addr22) (uint16, bool) {
+	if pa&1 == 1 || pa >= u.memtop() {
+		return 0, false
 	}
+	return u.core[pa>>1], true
+}
+
+// poke sets the word of memory at the physical address pa. Like peek it
+// has no side effects and returns false if pa is not in memory.
+func (u *UNIBUS) poke(pa addr22, v uint16) bool {
+	if pa&1 == 1 || pa >= u.memtop() {
+		return false
+	}
+	u.core[pa>>1] = v
+	return true
+}
+
+// read16 reads the physical address pa. If the read fails the cause is
+// recorded in the CPU error register and read16 returns false.
+func (u *UNIBUS) read16(pa addr22) (uint16, bool) {
+	// fmt.Printf("unibus: read16: %08o\n", pa)
+	if pa&1 == 1 {
+		fmt.Printf("unibus: read from odd address %08o\n", pa)
+		return 0, u.buserror(CPUERRODD)
+	}
+	if pa < u.memtop() {
+		return u.core[pa>>1], true
+	}
+	if pa < iopage {
+		fmt.Printf("unibus: read from non-existent memory %08o\n", pa)
+		return 0, u.buserror(CPUERRNXM)
+	}
+	var v uint16
+	var ok bool
+	addr := addr18(pa) & 0777777
 	switch addr & ^addr18(077) {
 	case 0777400:
-		return u.rk11.read16(addr)
+		v, ok = u.rk11.read16(addr)
 	case 0777500:
 		switch addr {
 		case 0777546:
-			return u.lineclock.read16(addr)
+			v, ok = u.lineclock.read16(addr)
 		case 0777572:
-			return u.mmu.SR0
+			v, ok = u.mmu.SR0, true
 		case 0777574:
-			return u.mmu.SR1
+			v, ok = u.mmu.SR1, true
 		case 0777576:
-			return u.mmu.SR2
+			v, ok = u.mmu.SR2, true
 		default:
-			return u.cons.read16(addr)
+			v, ok = u.cons.read16(addr)
 		}
 	case 0772200, 0772300, 0777600:
-		return u.mmu.read16(addr)
-	default:
+		v, ok = u.mmu.read16(addr)
+	case 0770200, 0770300:
+		v, ok = u.ubmapread16(addr)
+	case 0777700:
+		v, ok = u.cpuerr, addr == 0777766
+	case 0772500:
+		v, ok = u.mmu.SR3, addr == 0772516
+	}
+	if !ok {
 		fmt.Printf("unibus: read from invalid address %06o\n", addr)
-		panic(trap{INTBUS})
+		return 0, u.buserror(CPUERRTIMEOUT)
 	}
+	return v, true
 }
 
-// write16 writes v to addr on the UNIBUS.
-func (u *UNIBUS) write16(addr addr18, v uint16) {
-	if addr < 0760000 {
-		u.core[addr>>1] = v
-		return
+// write16 writes v to the physical address pa. If the write fails the cause
+// is recorded in the CPU error register and write16 returns false.
+func (u *UNIBUS) write16(pa addr22, v uint16) bool {
+	if pa&1 == 1 {
+		fmt.Printf("unibus: write to odd address %08o\n", pa)
+		return u.buserror(CPUERRODD)
 	}
-
+	if pa < u.memtop() {
+		u.core[pa>>1] = v
+		return true
+	}
+	if pa < iopage {
+		fmt.Printf("unibus: write to non-existent memory %08o\n", pa)
+		return u.buserror(CPUERRNXM)
+	}
+	ok := true
+	addr := addr18(pa) & 0777777
 	switch addr & ^addr18(077) {
 	case 0777400:
-		u.rk11.write16(addr, v)
+		ok = u.rk11.write16(addr, v)
 	case 0777500:
 		switch addr {
 		case 0777546:
-			u.lineclock.write16(addr, v)
+			ok = u.lineclock.write16(addr, v)
 		case 0777572:
-			u.mmu.SR0 = v
+			u.mmu.SR0 = v & sr0wmask
+			u.mmu.flush()
 		case 0777574:
 			u.mmu.SR1 = v
 		case 0777576:
 			u.mmu.SR2 = v
 		default:
-			u.cons.write16(addr, v)
+			ok = u.cons.write16(addr, v)
 		}
 	case 0772200, 0772300, 0777600:
-		u.mmu.write16(addr, v)
+		ok = u.mmu.write16(addr, v)
+	case 0770200, 0770300:
+		ok = u.ubmapwrite16(addr, v)
+	case 0777700:
+		if ok = addr == 0777766; ok {
+			u.cpuerr = 0 // any write clears the register
+		}
+	case 0772500:
+		if ok = addr == 0772516; ok {
+			u.mmu.SR3 = v & 067
+			u.mmu.flush()
+		}
 	default:
+		ok = false
+	}
+	if !ok {
 		fmt.Printf("unibus: write to invalid address %06o\n", addr)
-		panic(trap{INTBUS})
+		return u.buserror(CPUERRTIMEOUT)
 	}
+	return true
 }
 
+// ubmapread16 reads the Unibus map registers at 770200-770372.
+func (u *UNIBUS) ubmapread16(addr addr18) (uint16, bool) {
+	i := (addr - 0770200) >> 2
+	if i >= addr18(len(u.ubmap)) {
+		return 0, false
+	}
+	if addr&2 == 0 {
+		return uint16(u.ubmap[i]), true
+	}
+	return uint16(u.ubmap[i] >> 16), true
+}
+
+// ubmapwrite16 writes the Unibus map registers at 770200-770372.
+func (u *UNIBUS) ubmapwrite16(addr addr18, v uint16) bool {
+	i := (addr - 0770200) >> 2
+	if i >= addr18(len(u.ubmap)) {
+		return false
+	}
+	if addr&2 == 0 {
+		u.ubmap[i] = u.ubmap[i]&^0177777 | addr22(v&^1)
+		return true
+	}
+	u.ubmap[i] = u.ubmap[i]&0177777 | addr22(v&077)<<16
+	return true
+}
+
+// ubaddr translates the Unibus address addr to a physical address. When
+// the Unibus map is enabled in SR3 the top five bits of addr select a map
+// register, otherwise addr is used as is. The I/O page is never mapped.
+func (u *UNIBUS) ubaddr(addr addr18) addr22 {
+	addr &= 0777777
+	switch {
+	case addr >= 0760000:
+		return iopage | addr22(addr&017777)
+	case u.mmu.SR3&SR3UBMAP == SR3UBMAP:
+		return (u.ubmap[addr>>13] + addr22(addr&017777)) & 017777777
+	default:
+		return addr22(addr)
+	}
+}
+
+// dmaread16 reads the word at the Unibus address addr for a DMA device.
+func (u *UNIBUS) dmaread16(addr addr18) (uint16, bool) { return u.read16(u.ubaddr(addr)) }
+
+// dmawrite16 writes v to the Unibus address addr for a DMA device.
+func (u *UNIBUS) dmawrite16(addr addr18, v uint16) bool { return u.write16(u.ubaddr(addr), v) }
+
+// busy reports whether a device has work in progress which completes
+// without the cpu, so a waiting cpu should not sleep.
+func (u *UNIBUS) busy() bool { return u.cons.busy() || u.rk11.busy() }
+
 func (u *UNIBUS) reset() {
+	u.cpuerr = 0
 	u.cons.reset()
 	u.rk11.reset()
 	u.lineclock.write16(0777546, 0x00) // disable line clock INTR
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestUnibusMap(t *testing.T) {
+	is := is.New(t)
+	var cpu KB11
+	u := &cpu.unibus
+	u.mmu = &cpu.mmu
+	u.memsize = 04000000 // 1 MB
+
+	u.write16(017770210, 0000100) // UBMAP2 low
+	u.write16(017770212, 0000005) // UBMAP2 high
+	v, _ := u.read16(017770210)
+	is.Equal(v, uint16(0000100))
+	v, _ = u.read16(017770212)
+	is.Equal(v, uint16(0000005))
+
+	// disabled, unibus addresses are physical addresses
+	u.dmawrite16(0040004, 1)
+	is.Equal(u.core[0040004>>1], uint16(1))
+
+	u.write16(017772516, SR3UBMAP)
+	u.dmawrite16(0040004, 2)
+	is.Equal(u.core[01200104>>1], uint16(2))
+	v, _ = u.dmaread16(0040004)
+	is.Equal(v, uint16(2))
+
+	// the I/O page is not mapped
+	v, _ = u.dmaread16(0772516)
+	is.Equal(v, uint16(SR3UBMAP))
+}